@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"github.com/rs/zerolog"
 	"os"
 	"os/signal"
+	"rclone-manager/internal/cli"
 	"rclone-manager/internal/rclone_manager"
 	"strings"
 	"syscall"
-	"time"
 )
 
 var logger zerolog.Logger
@@ -22,19 +23,29 @@ func init() {
 }
 
 func main() {
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-
-	rclone_manager.InitializeRClone(logger)
-
-	for {
-		select {
-		case sig := <-sigs:
-			logger.Warn().Msgf("Received signal %v, shutting down...", sig)
-			rclone_manager.StopRclone(logger)
-			os.Exit(0)
-		default:
-			time.Sleep(1 * time.Second)
+	if len(os.Args) > 1 {
+		os.Exit(cli.Run(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	manager := rclone_manager.NewManager(logger)
+
+	resets := make(chan os.Signal, 1)
+	signal.Notify(resets, syscall.SIGUSR1)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-resets:
+				manager.ResetBreakers()
+			}
 		}
+	}()
+
+	if err := manager.Run(ctx); err != nil {
+		logger.Fatal().Err(err).Msg("rclone manager failed")
 	}
 }
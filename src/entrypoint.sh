@@ -1,5 +1,11 @@
 #!/bin/sh
 
+# Subcommands such as validate and plan only read the files they are given, so
+# they run without the user setup and leave the ownership of /data alone
+if [ "$#" -gt 0 ]; then
+    exec /usr/local/bin/rclone-manager "$@"
+fi
+
 PUID=${PUID:-1000}
 PGID=${PGID:-1000}
 
@@ -13,4 +19,4 @@ fi
 
 chown -R rclonemanager:rclonemanager /data
 
-exec su-exec rclonemanager "/usr/local/bin/rclone-manager"
+exec su-exec rclonemanager "/usr/local/bin/rclone-manager" "$@"
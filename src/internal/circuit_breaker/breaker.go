@@ -0,0 +1,119 @@
+package circuit_breaker
+
+import (
+	"rclone-manager/internal/config"
+	"rclone-manager/internal/constants"
+	"rclone-manager/internal/status"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Breaker counts restarts of every unit that uses the same backend, so a mount
+// and a serve on a failing remote trip it together instead of doubling the load.
+type Breaker struct {
+	Backend   string
+	Restarts  []time.Time
+	TrippedAt time.Time
+	OpenUntil time.Time
+}
+
+// Breakers holds the breaker of every backend that was restarted, and records
+// those that are open in the status.
+type Breakers struct {
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+	status   *status.Recorder
+}
+
+func NewBreakers(recorder *status.Recorder) *Breakers {
+	return &Breakers{breakers: make(map[string]*Breaker), status: recorder}
+}
+
+// IsOpen reports whether restarts of backend are held back, and until when. A
+// breaker whose cool-down has expired is closed again.
+func (b *Breakers) IsOpen(backend string, now time.Time) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	breaker, ok := b.breakers[backend]
+	if !ok || breaker.OpenUntil.IsZero() {
+		return time.Time{}, false
+	}
+	if now.Before(breaker.OpenUntil) {
+		return breaker.OpenUntil, true
+	}
+
+	delete(b.breakers, backend)
+	b.status.SetBreaker(backend, nil)
+	return time.Time{}, false
+}
+
+// Record counts a restart of a unit using backend. When the unit's policy
+// allows no more restarts within its window the breaker trips instead, and
+// Record returns true along with the end of the cool-down.
+func (b *Breakers) Record(backend string, now time.Time, policy config.RestartConfig) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	breaker, ok := b.breakers[backend]
+	if !ok {
+		breaker = &Breaker{Backend: backend}
+		b.breakers[backend] = breaker
+	}
+
+	kept := breaker.Restarts[:0]
+	for _, restart := range breaker.Restarts {
+		if restart.After(now.Add(-policy.Window)) {
+			kept = append(kept, restart)
+		}
+	}
+	breaker.Restarts = kept
+
+	if maxRestarts := *policy.MaxRestarts; maxRestarts > 0 && len(breaker.Restarts) >= maxRestarts {
+		breaker.TrippedAt = now
+		breaker.OpenUntil = now.Add(policy.CoolDown)
+		b.status.SetBreaker(backend, &status.Breaker{
+			State:     constants.BreakerOpen,
+			Restarts:  len(breaker.Restarts),
+			TrippedAt: breaker.TrippedAt,
+			OpenUntil: breaker.OpenUntil,
+		})
+		return breaker.OpenUntil, true
+	}
+
+	breaker.Restarts = append(breaker.Restarts, now)
+	return time.Time{}, false
+}
+
+// Reset closes the breaker of backend and forgets its restart history. It
+// reports whether the breaker was open.
+func (b *Breakers) Reset(backend string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	breaker, ok := b.breakers[backend]
+	if !ok {
+		return false
+	}
+	delete(b.breakers, backend)
+	b.status.SetBreaker(backend, nil)
+	return !breaker.OpenUntil.IsZero()
+}
+
+// ResetAll closes every breaker and returns the backends whose breaker was open.
+func (b *Breakers) ResetAll() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var opened []string
+	for backend, breaker := range b.breakers {
+		if !breaker.OpenUntil.IsZero() {
+			opened = append(opened, backend)
+		}
+		delete(b.breakers, backend)
+		b.status.SetBreaker(backend, nil)
+	}
+	sort.Strings(opened)
+	return opened
+}
@@ -0,0 +1,111 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"rclone-manager/internal/config"
+	"rclone-manager/internal/rclone_conf"
+	"strings"
+)
+
+const (
+	exitOK      = 0
+	exitInvalid = 1
+	exitUsage   = 2
+)
+
+const usage = `Usage:
+  rclone-manager                                         supervise mounts and serves
+  rclone-manager validate [-rclone-conf path] <config.yaml>
+  rclone-manager plan [-current path] [-rclone-conf path] [-current-rclone-conf path] <config.yaml>
+
+plan compares the units of the current config and rclone.conf with those of
+the candidate ones. It prints the rclone argv and environment of each unit
+with secrets redacted, and the environment only lists what the unit sets on
+top of the container environment it inherits.
+`
+
+// Run executes a subcommand and returns the process exit code.
+func Run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "validate":
+		return runValidate(args[1:], stdout, stderr)
+	case "plan":
+		return runPlan(args[1:], stdout, stderr)
+	case "help", "-h", "--help":
+		fmt.Fprint(stdout, usage)
+		return exitOK
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], usage)
+		return exitUsage
+	}
+}
+
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	rcloneConfPath := flags.String("rclone-conf", rclone_conf.Path(), "rclone.conf used to check that remotes exist")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+	path := flags.Arg(0)
+
+	conf, ok := loadCandidate(path, stdout, stderr)
+	if !ok {
+		return exitInvalid
+	}
+
+	remotes, err := rclone_conf.Load(*rcloneConfPath)
+	if err != nil {
+		fmt.Fprintf(stdout, "warning: skipping remote checks, cannot read %s: %v\n", *rcloneConfPath, err)
+	} else {
+		for _, problem := range conf.CheckRemotes(remoteDefined(remotes)) {
+			fmt.Fprintf(stdout, "warning: %s (not in %s or RCLONE_CONFIG_* environment)\n", problem, *rcloneConfPath)
+		}
+	}
+
+	fmt.Fprintf(stdout, "%s is valid (revision %s, mode %s): %d mounts, %d serves\n",
+		path, conf.Revision, conf.Mode, len(conf.Mounts), len(conf.Serves))
+	return exitOK
+}
+
+// loadCandidate loads a config and prints every problem when it is invalid.
+func loadCandidate(path string, stdout, stderr io.Writer) (*config.Config, bool) {
+	conf, err := config.LoadConfigFromFile(path)
+	if err == nil {
+		return conf, true
+	}
+
+	var validationErr *config.ValidationError
+	if !errors.As(err, &validationErr) {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return nil, false
+	}
+
+	fmt.Fprintf(stdout, "%s is invalid (revision %s), %d problems:\n", path, validationErr.Revision, len(validationErr.Problems))
+	for _, message := range validationErr.Messages() {
+		fmt.Fprintf(stdout, "  %s\n", message)
+	}
+	return nil, false
+}
+
+func remoteDefined(remotes *rclone_conf.RcloneConf) func(string) bool {
+	return func(name string) bool {
+		if remotes.Section(name) != nil {
+			return true
+		}
+		return os.Getenv("RCLONE_CONFIG_"+strings.ToUpper(name)+"_TYPE") != ""
+	}
+}
@@ -0,0 +1,133 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"rclone-manager/internal/config"
+	"rclone-manager/internal/planner"
+	"rclone-manager/internal/rclone_conf"
+	"rclone-manager/internal/spec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var actionSymbols = map[planner.Action]string{
+	planner.ActionStart:     "+",
+	planner.ActionStop:      "-",
+	planner.ActionRestart:   "~",
+	planner.ActionUnchanged: "=",
+}
+
+func runPlan(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	currentPath := flags.String("current", config.Path(), "config.yaml currently applied")
+	rcloneConfPath := flags.String("rclone-conf", rclone_conf.Path(), "rclone.conf the units would run with")
+	currentRcloneConfPath := flags.String("current-rclone-conf", "", "rclone.conf the running units were started with (default: -rclone-conf)")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	candidate, ok := loadCandidate(flags.Arg(0), stdout, stderr)
+	if !ok {
+		return exitInvalid
+	}
+
+	current, err := config.LoadConfigFromFile(*currentPath)
+	if err != nil {
+		var validationErr *config.ValidationError
+		if errors.As(err, &validationErr) || !os.IsNotExist(err) {
+			fmt.Fprintf(stdout, "warning: current config %s cannot be used (%v), planning from scratch\n", *currentPath, err)
+		}
+		current = nil
+	}
+
+	remotes := loadRemotes(*rcloneConfPath, stdout)
+	currentRemotes := remotes
+	if *currentRcloneConfPath != "" {
+		currentRemotes = loadRemotes(*currentRcloneConfPath, stdout)
+	}
+
+	if current != nil {
+		fmt.Fprintf(stdout, "Plan: %s (revision %s, mode %s) -> %s (revision %s, mode %s)\n\n",
+			*currentPath, current.Revision, current.Mode, flags.Arg(0), candidate.Revision, candidate.Mode)
+		if current.Mode != candidate.Mode {
+			fmt.Fprintln(stdout, "note: changing mode is only applied when the container restarts")
+			fmt.Fprintln(stdout)
+		}
+	} else {
+		fmt.Fprintf(stdout, "Plan: nothing running -> %s (revision %s, mode %s)\n\n", flags.Arg(0), candidate.Revision, candidate.Mode)
+	}
+
+	counts := make(map[planner.Action]int)
+	for _, step := range planner.Plan(current, candidate, currentRemotes, remotes) {
+		counts[step.Action]++
+		printStep(stdout, step)
+	}
+
+	fmt.Fprintf(stdout, "%d to start, %d to restart, %d to stop, %d unchanged\n",
+		counts[planner.ActionStart], counts[planner.ActionRestart], counts[planner.ActionStop], counts[planner.ActionUnchanged])
+	return exitOK
+}
+
+func loadRemotes(path string, stdout io.Writer) *rclone_conf.RcloneConf {
+	remotes, err := rclone_conf.Load(path)
+	if err != nil {
+		fmt.Fprintf(stdout, "warning: cannot read %s (%v), remote changes are not considered\n", path, err)
+		return &rclone_conf.RcloneConf{}
+	}
+	return remotes
+}
+
+func printStep(w io.Writer, step planner.Step) {
+	fmt.Fprintf(w, "  %s %-9s %s %s\n", actionSymbols[step.Action], step.Action, step.Kind, step.Name)
+	for _, reason := range step.Reasons {
+		fmt.Fprintf(w, "      because: %s\n", reason)
+	}
+	if step.Action != planner.ActionStop {
+		printSpec(w, step.Spec)
+	}
+	fmt.Fprintln(w)
+}
+
+func printSpec(w io.Writer, s *spec.Spec) {
+	if s.Binary == "" {
+		fmt.Fprintf(w, "      rc:   %s\n", quoteArgs(spec.RedactArgs(s.Args)))
+		return
+	}
+
+	fmt.Fprintf(w, "      argv: %s %s\n", s.Binary, quoteArgs(spec.RedactArgs(s.Args)))
+
+	keys := make([]string, 0, len(s.Environment))
+	for key := range s.Environment {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 {
+		fmt.Fprintln(w, "      env:  (container environment only)")
+		return
+	}
+	fmt.Fprintln(w, "      env:  container environment, plus")
+	for _, key := range keys {
+		fmt.Fprintf(w, "            %s=%s\n", key, spec.RedactEnv(key, s.Environment[key]))
+	}
+}
+
+func quoteArgs(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\$`*?") {
+			arg = strconv.Quote(arg)
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
@@ -1,54 +1,327 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"gopkg.in/yaml.v3"
 	"os"
 	"rclone-manager/internal/constants"
 	"rclone-manager/internal/environment"
+	"time"
 )
 
 type Config struct {
-	Serves []struct {
-		BackendName string            `yaml:"backendName"`
-		Protocol    string            `yaml:"protocol"`
-		Addr        string            `yaml:"addr"`
-		Environment map[string]string `yaml:"environment,omitempty"`
-	} `yaml:"serves"`
+	Mode string    `yaml:"mode,omitempty"`
+	Rcd  RcdConfig `yaml:"rcd,omitempty"`
 
-	Mounts []struct {
-		BackendName string            `yaml:"backendName"`
-		MountPoint  string            `yaml:"mountPoint"`
-		Environment map[string]string `yaml:"environment,omitempty"`
-	} `yaml:"mounts"`
+	Restart RestartConfig `yaml:"restart,omitempty"`
+
+	// StopTimeout is how long a unit is given to exit after SIGTERM before it
+	// is killed, ShutdownTimeout bounds stopping everything on shutdown
+	StopTimeout     time.Duration `yaml:"stopTimeout,omitempty"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout,omitempty"`
+
+	// OnBusy is what happens when processes still hold files open under a
+	// mount point that is about to be unmounted, see the OnBusy constants
+	OnBusy      string        `yaml:"onBusy,omitempty"`
+	BusyTimeout time.Duration `yaml:"busyTimeout,omitempty"`
+
+	// PropagationCheck is what happens when a mount point is not on a
+	// filesystem with shared propagation, see the PropagationCheck constants
+	PropagationCheck string `yaml:"propagationCheck,omitempty"`
+
+	OrphanMounts OrphanMountsConfig `yaml:"orphanMounts,omitempty"`
+
+	Serves []Serve `yaml:"serves"`
+	Mounts []Mount `yaml:"mounts"`
+
+	// Revision identifies the file contents the config was loaded from
+	Revision string `yaml:"-"`
+
+	pos position
+}
+
+type Serve struct {
+	Name        string            `yaml:"name,omitempty"`
+	BackendName string            `yaml:"backendName"`
+	RemotePath  string            `yaml:"remotePath,omitempty"`
+	Protocol    string            `yaml:"protocol"`
+	Addr        string            `yaml:"addr"`
+	Environment map[string]string `yaml:"environment,omitempty"`
+	Args        []string          `yaml:"args,omitempty"`
+	Flags       Flags             `yaml:"flags,omitempty"`
+	Restart     RestartConfig     `yaml:"restart,omitempty"`
+	StopTimeout time.Duration     `yaml:"stopTimeout,omitempty"`
+	Probe       ProbeConfig       `yaml:"probe,omitempty"`
+
+	pos position
+}
+
+type Mount struct {
+	Name        string            `yaml:"name,omitempty"`
+	BackendName string            `yaml:"backendName"`
+	RemotePath  string            `yaml:"remotePath,omitempty"`
+	MountPoint  string            `yaml:"mountPoint"`
+	Environment map[string]string `yaml:"environment,omitempty"`
+	Args        []string          `yaml:"args,omitempty"`
+	Flags       Flags             `yaml:"flags,omitempty"`
+	Restart     RestartConfig     `yaml:"restart,omitempty"`
+	StopTimeout time.Duration     `yaml:"stopTimeout,omitempty"`
+	OnBusy      string            `yaml:"onBusy,omitempty"`
+	BusyTimeout time.Duration     `yaml:"busyTimeout,omitempty"`
+
+	// DirMode, Owner and Group are applied to the mount point when it is
+	// created and restored before every start, unset ones are left alone
+	DirMode string `yaml:"dirMode,omitempty"`
+	Owner   string `yaml:"owner,omitempty"`
+	Group   string `yaml:"group,omitempty"`
+	// AllowNonEmpty mounts over a mount point that has files in it, which
+	// hides them while mounted. RCLONE_ALLOW_NON_EMPTY allows it as well
+	AllowNonEmpty bool `yaml:"allowNonEmpty,omitempty"`
+
+	PropagationCheck string `yaml:"propagationCheck,omitempty"`
+
+	Probe MountProbeConfig `yaml:"probe,omitempty"`
+
+	pos position
+}
+
+// The defaults fit inside the stop_grace_period of 30s set in compose.yaml.
+const (
+	DefaultStopTimeout     = 15 * time.Second
+	DefaultShutdownTimeout = 25 * time.Second
+	DefaultBusyTimeout     = 30 * time.Second
+)
+
+// OrphanMountsConfig lists the roots under which rclone mounts that are not
+// in the config are unmounted at startup, e.g. left over from a mount point
+// removed while the manager was down. DryRun only reports them.
+type OrphanMountsConfig struct {
+	Roots  []string `yaml:"roots,omitempty"`
+	DryRun bool     `yaml:"dryRun,omitempty"`
+
+	pos position
+}
+
+type RcdConfig struct {
+	Addr        string            `yaml:"addr,omitempty"`
+	User        string            `yaml:"user,omitempty"`
+	Pass        string            `yaml:"pass,omitempty"`
+	Timeout     time.Duration     `yaml:"timeout,omitempty"`
+	Environment map[string]string `yaml:"environment,omitempty"`
+
+	pos position
+}
+
+// position remembers where an entry and each of its keys were defined, so
+// validation problems can point at YAML line numbers.
+type position struct {
+	line   int
+	fields map[string]int
+}
+
+func (p *position) record(node *yaml.Node) {
+	p.line = node.Line
+	p.fields = make(map[string]int)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		p.fields[node.Content[i].Value] = node.Content[i].Line
+	}
+}
+
+// has reports whether the key was set.
+func (p position) has(field string) bool {
+	_, ok := p.fields[field]
+	return ok
+}
+
+func (p position) lineOf(field string) int {
+	if line, ok := p.fields[field]; ok {
+		return line
+	}
+	return p.line
+}
+
+func (c *Config) UnmarshalYAML(node *yaml.Node) error {
+	type plain Config
+	if err := node.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	c.pos.record(node)
+	return nil
+}
+
+func (s *Serve) UnmarshalYAML(node *yaml.Node) error {
+	type plain Serve
+	if err := node.Decode((*plain)(s)); err != nil {
+		return err
+	}
+	s.pos.record(node)
+	return nil
+}
+
+func (m *Mount) UnmarshalYAML(node *yaml.Node) error {
+	type plain Mount
+	if err := node.Decode((*plain)(m)); err != nil {
+		return err
+	}
+	m.pos.record(node)
+	return nil
+}
+
+func (o *OrphanMountsConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plain OrphanMountsConfig
+	if err := node.Decode((*plain)(o)); err != nil {
+		return err
+	}
+	o.pos.record(node)
+	return nil
+}
+
+func (r *RcdConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plain RcdConfig
+	if err := node.Decode((*plain)(r)); err != nil {
+		return err
+	}
+	r.pos.record(node)
+	return nil
 }
 
 func LoadConfig() (*Config, error) {
-	yamlPath := environment.GetEnvWithFallback(constants.YAMLPathEnvVar, constants.DefaultYAMLPath)
+	return LoadConfigFromFile(Path())
+}
+
+func Path() string {
+	return environment.GetEnvWithFallback(constants.YAMLPathEnvVar, constants.DefaultYAMLPath)
+}
+
+// LoadConfigFromFile reads, defaults and validates a config file. Parse and
+// validation failures are returned as a *ValidationError carrying the rejected revision.
+func LoadConfigFromFile(yamlPath string) (*Config, error) {
 	data, err := os.ReadFile(yamlPath)
 	if err != nil {
 		return nil, err
 	}
 
+	revision := revisionOf(data)
+
 	var config Config
 	err = yaml.Unmarshal(data, &config)
 	if err != nil {
+		return nil, &ValidationError{Revision: revision, Problems: []Problem{{Message: err.Error()}}}
+	}
+	config.Revision = revision
+
+	config.applyDefaults()
+	if err := config.Validate(); err != nil {
 		return nil, err
 	}
+
 	return &config, nil
 }
 
-func IsMountInConfig(mountPoint string, conf *Config) bool {
+func (c *Config) IsRcdMode() bool {
+	return c.Mode == constants.ModeRcd
+}
+
+// DefaultName derives a name from the fields that make a mount unique, used
+// when no explicit name is configured.
+func (m Mount) DefaultName() string {
+	return fmt.Sprintf("%s@%s", displaySource(m.BackendName, m.RemotePath), m.MountPoint)
+}
+
+func (s Serve) DefaultName() string {
+	return fmt.Sprintf("%s-%s@%s", displaySource(s.BackendName, s.RemotePath), s.Protocol, s.Addr)
+}
+
+// Source is the rclone source argument, e.g. "AllDebrid:" or "AllDebrid:/torrents".
+func (m Mount) Source() string {
+	return source(m.BackendName, m.RemotePath)
+}
+
+func (s Serve) Source() string {
+	return source(s.BackendName, s.RemotePath)
+}
+
+func source(backendName, remotePath string) string {
+	return fmt.Sprintf("%s:%s", backendName, remotePath)
+}
+
+func displaySource(backendName, remotePath string) string {
+	if remotePath == "" {
+		return backendName
+	}
+	return source(backendName, remotePath)
+}
+
+func (c *Config) applyDefaults() {
+	if c.Mode == "" {
+		c.Mode = constants.ModeProcess
+	}
+	c.Restart = c.Restart.withDefaults(DefaultRestart)
+	if c.StopTimeout == 0 {
+		c.StopTimeout = DefaultStopTimeout
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	if c.OnBusy == "" {
+		c.OnBusy = constants.OnBusyLazy
+	}
+	if c.BusyTimeout == 0 {
+		c.BusyTimeout = DefaultBusyTimeout
+	}
+	if c.PropagationCheck == "" {
+		c.PropagationCheck = constants.PropagationCheckWarn
+	}
+	for i := range c.Mounts {
+		if c.Mounts[i].Name == "" {
+			c.Mounts[i].Name = c.Mounts[i].DefaultName()
+		}
+		c.Mounts[i].Restart = c.Mounts[i].Restart.withDefaults(c.Restart)
+		if c.Mounts[i].StopTimeout == 0 {
+			c.Mounts[i].StopTimeout = c.StopTimeout
+		}
+		if c.Mounts[i].OnBusy == "" {
+			c.Mounts[i].OnBusy = c.OnBusy
+		}
+		if c.Mounts[i].BusyTimeout == 0 {
+			c.Mounts[i].BusyTimeout = c.BusyTimeout
+		}
+		if c.Mounts[i].PropagationCheck == "" {
+			c.Mounts[i].PropagationCheck = c.PropagationCheck
+		}
+		c.Mounts[i].Probe = c.Mounts[i].Probe.withDefaults()
+	}
+	for i := range c.Serves {
+		if c.Serves[i].Name == "" {
+			c.Serves[i].Name = c.Serves[i].DefaultName()
+		}
+		c.Serves[i].Restart = c.Serves[i].Restart.withDefaults(c.Restart)
+		if c.Serves[i].StopTimeout == 0 {
+			c.Serves[i].StopTimeout = c.StopTimeout
+		}
+		c.Serves[i].Probe = c.Serves[i].Probe.withDefaults(c.Serves[i].Protocol)
+	}
+}
+
+func revisionOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func IsMountInConfig(name string, conf *Config) bool {
 	for _, mount := range conf.Mounts {
-		if mount.MountPoint == mountPoint {
+		if mount.Name == name {
 			return true
 		}
 	}
 	return false
 }
 
-func IsServeInConfig(backend string, conf *Config) bool {
-	for _, mount := range conf.Serves {
-		if mount.BackendName == backend {
+func IsServeInConfig(name string, conf *Config) bool {
+	for _, serve := range conf.Serves {
+		if serve.Name == name {
 			return true
 		}
 	}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strings"
+)
+
+// Flags maps rclone flag names (with or without the leading --) to their
+// values. A list repeats the flag, e.g. exclude: ["*.tmp", "*.part"].
+type Flags map[string]FlagValues
+
+type FlagValues []string
+
+func (f *FlagValues) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		*f = FlagValues{node.Value}
+		return nil
+	case yaml.SequenceNode:
+		var values []string
+		if err := node.Decode(&values); err != nil {
+			return err
+		}
+		*f = values
+		return nil
+	default:
+		return fmt.Errorf("line %d: flag values must be a scalar or a list", node.Line)
+	}
+}
+
+// Args renders the flags as --name=value arguments, sorted by name so the
+// result is stable.
+func (f Flags) Args() []string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var args []string
+	for _, name := range names {
+		for _, value := range f[name] {
+			args = append(args, fmt.Sprintf("--%s=%s", FlagName(name), value))
+		}
+	}
+	return args
+}
+
+// FlagName normalises "--vfs-cache-mode=full", "--vfs-cache-mode" and
+// "vfs-cache-mode" to "vfs-cache-mode".
+func FlagName(arg string) string {
+	name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+	return name
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+)
+
+// accountName is what a user or group name may look like, it is only looked
+// up once the mount point is prepared, where the name has to exist.
+var accountName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9._-]*\$?$`)
+
+// ParseMode parses the octal permissions of a mount point, e.g. "0755".
+func ParseMode(mode string) (os.FileMode, error) {
+	bits, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || bits > 0o777 {
+		return 0, fmt.Errorf("must be octal permissions like \"0755\", got %q", mode)
+	}
+	return os.FileMode(bits), nil
+}
+
+// checkAccount accepts a numeric id or something that looks like a name.
+func checkAccount(account string) error {
+	if id, err := strconv.Atoi(account); err == nil {
+		if id < 0 {
+			return fmt.Errorf("must not be negative, got %d", id)
+		}
+		return nil
+	}
+	if !accountName.MatchString(account) {
+		return fmt.Errorf("must be a name or a numeric id, got %q", account)
+	}
+	return nil
+}
+
+// LookupOwner resolves a user name or numeric uid to a uid.
+func LookupOwner(owner string) (int, error) {
+	if uid, err := strconv.Atoi(owner); err == nil && uid >= 0 {
+		return uid, nil
+	}
+	u, err := user.Lookup(owner)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// LookupGroup resolves a group name or numeric gid to a gid.
+func LookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil && gid >= 0 {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
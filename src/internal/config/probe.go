@@ -0,0 +1,127 @@
+package config
+
+import (
+	"gopkg.in/yaml.v3"
+	"rclone-manager/internal/constants"
+	"slices"
+	"time"
+)
+
+// ProbeConfig controls how a serve is checked. The type defaults by protocol,
+// http for protocols served over HTTP, ssh for sftp and tcp for the rest. An
+// HTTP probe without expectStatus accepts any status below 500. Probes failing
+// while the serve starts only count against StartupTimeout.
+type ProbeConfig struct {
+	Type             string        `yaml:"type,omitempty"`
+	Path             string        `yaml:"path,omitempty"`
+	ExpectStatus     []int         `yaml:"expectStatus,omitempty"`
+	InitialDelay     time.Duration `yaml:"initialDelay,omitempty"`
+	Period           time.Duration `yaml:"period,omitempty"`
+	Timeout          time.Duration `yaml:"timeout,omitempty"`
+	FailureThreshold int           `yaml:"failureThreshold,omitempty"`
+	StartupTimeout   time.Duration `yaml:"startupTimeout,omitempty"`
+
+	pos position
+}
+
+var DefaultProbe = ProbeConfig{
+	Path:             "/",
+	Period:           15 * time.Second,
+	Timeout:          5 * time.Second,
+	FailureThreshold: 3,
+	StartupTimeout:   time.Minute,
+}
+
+// MountProbeConfig controls how a mount is checked. Every check stats and
+// lists its mount point, which may take as long as rclone needs to list the
+// root of the remote. Only a check failing with ENOTCONN restarts the mount
+// right away, slow or failed listings count against FailureThreshold.
+type MountProbeConfig struct {
+	Period           time.Duration `yaml:"period,omitempty"`
+	Timeout          time.Duration `yaml:"timeout,omitempty"`
+	FailureThreshold int           `yaml:"failureThreshold,omitempty"`
+	StartupTimeout   time.Duration `yaml:"startupTimeout,omitempty"`
+
+	pos position
+}
+
+var DefaultMountProbe = MountProbeConfig{
+	Period:           15 * time.Second,
+	Timeout:          10 * time.Second,
+	FailureThreshold: 3,
+	StartupTimeout:   time.Minute,
+}
+
+var httpProtocols = []string{"http", "restic", "s3", "webdav"}
+
+func (p *ProbeConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plain ProbeConfig
+	if err := node.Decode((*plain)(p)); err != nil {
+		return err
+	}
+	p.pos.record(node)
+	return nil
+}
+
+func (p *MountProbeConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plain MountProbeConfig
+	if err := node.Decode((*plain)(p)); err != nil {
+		return err
+	}
+	p.pos.record(node)
+	return nil
+}
+
+// DefaultProbeType is the probe that fits what a serve of protocol speaks.
+func DefaultProbeType(protocol string) string {
+	switch {
+	case slices.Contains(httpProtocols, protocol):
+		return constants.ProbeHTTP
+	case protocol == "sftp":
+		return constants.ProbeSSH
+	default:
+		return constants.ProbeTCP
+	}
+}
+
+// withDefaults fills every field that is not set from DefaultProbe.
+func (p ProbeConfig) withDefaults(protocol string) ProbeConfig {
+	if p.Type == "" {
+		p.Type = DefaultProbeType(protocol)
+	}
+	if p.Path == "" {
+		p.Path = DefaultProbe.Path
+	}
+	if p.Period == 0 {
+		p.Period = DefaultProbe.Period
+	}
+	if p.Timeout == 0 {
+		p.Timeout = DefaultProbe.Timeout
+	}
+	// An explicit 0 disables the restart on failed checks or a slow start
+	if p.FailureThreshold == 0 && !p.pos.has("failureThreshold") {
+		p.FailureThreshold = DefaultProbe.FailureThreshold
+	}
+	if p.StartupTimeout == 0 && !p.pos.has("startupTimeout") {
+		p.StartupTimeout = DefaultProbe.StartupTimeout
+	}
+	return p
+}
+
+// withDefaults fills every field that is not set from DefaultMountProbe.
+func (p MountProbeConfig) withDefaults() MountProbeConfig {
+	if p.Period == 0 {
+		p.Period = DefaultMountProbe.Period
+	}
+	if p.Timeout == 0 {
+		p.Timeout = DefaultMountProbe.Timeout
+	}
+	// An explicit 0 disables the restart on failed checks or a slow start
+	if p.FailureThreshold == 0 && !p.pos.has("failureThreshold") {
+		p.FailureThreshold = DefaultMountProbe.FailureThreshold
+	}
+	if p.StartupTimeout == 0 && !p.pos.has("startupTimeout") {
+		p.StartupTimeout = DefaultMountProbe.StartupTimeout
+	}
+	return p
+}
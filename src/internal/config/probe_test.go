@@ -0,0 +1,45 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProbeZeroDisablesRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := `mounts:
+  - backendName: A
+    mountPoint: /mnt/a
+    probe:
+      failureThreshold: 0
+      startupTimeout: 0s
+serves:
+  - backendName: A
+    protocol: webdav
+    addr: :8080
+    probe:
+      failureThreshold: 0
+  - backendName: A
+    protocol: ftp
+    addr: :2121
+`
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := LoadConfigFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if probe := conf.Mounts[0].Probe; probe.FailureThreshold != 0 || probe.StartupTimeout != 0 {
+		t.Errorf("mount probe = %+v, want the explicit zeros kept", probe)
+	}
+	if probe := conf.Serves[0].Probe; probe.FailureThreshold != 0 || probe.StartupTimeout != time.Minute {
+		t.Errorf("serve probe = %+v, want failureThreshold 0 and the default startupTimeout", probe)
+	}
+	if probe := conf.Serves[1].Probe; probe.FailureThreshold != DefaultProbe.FailureThreshold {
+		t.Errorf("serve probe = %+v, want the default failureThreshold", probe)
+	}
+}
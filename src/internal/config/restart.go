@@ -0,0 +1,80 @@
+package config
+
+import (
+	"gopkg.in/yaml.v3"
+	"rclone-manager/internal/constants"
+	"time"
+)
+
+// RestartConfig controls how a unit is restarted after it exits or fails to
+// start. Unset fields on a unit inherit the top level restart block, which in
+// turn inherits DefaultRestart.
+type RestartConfig struct {
+	Policy         string        `yaml:"policy,omitempty"`
+	InitialBackoff time.Duration `yaml:"initialBackoff,omitempty"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff,omitempty"`
+	Jitter         *float64      `yaml:"jitter,omitempty"`
+	MaxRestarts    *int          `yaml:"maxRestarts,omitempty"`
+	Window         time.Duration `yaml:"window,omitempty"`
+	GracePeriod    time.Duration `yaml:"gracePeriod,omitempty"`
+	CoolDown       time.Duration `yaml:"coolDown,omitempty"`
+
+	pos position
+}
+
+var DefaultRestart = RestartConfig{
+	Policy:         constants.RestartAlways,
+	InitialBackoff: 5 * time.Second,
+	MaxBackoff:     5 * time.Minute,
+	Jitter:         floatPtr(0.2),
+	MaxRestarts:    intPtr(10),
+	Window:         10 * time.Minute,
+	GracePeriod:    10 * time.Second,
+	CoolDown:       15 * time.Minute,
+}
+
+func (r *RestartConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plain RestartConfig
+	if err := node.Decode((*plain)(r)); err != nil {
+		return err
+	}
+	r.pos.record(node)
+	return nil
+}
+
+// withDefaults fills every unset field from defaults.
+func (r RestartConfig) withDefaults(defaults RestartConfig) RestartConfig {
+	if r.Policy == "" {
+		r.Policy = defaults.Policy
+	}
+	if r.InitialBackoff == 0 {
+		r.InitialBackoff = defaults.InitialBackoff
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = defaults.MaxBackoff
+	}
+	if r.Jitter == nil {
+		r.Jitter = defaults.Jitter
+	}
+	if r.MaxRestarts == nil {
+		r.MaxRestarts = defaults.MaxRestarts
+	}
+	if r.Window == 0 {
+		r.Window = defaults.Window
+	}
+	if r.GracePeriod == 0 {
+		r.GracePeriod = defaults.GracePeriod
+	}
+	if r.CoolDown == 0 {
+		r.CoolDown = defaults.CoolDown
+	}
+	return r
+}
+
+func floatPtr(value float64) *float64 {
+	return &value
+}
+
+func intPtr(value int) *int {
+	return &value
+}
@@ -0,0 +1,441 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"rclone-manager/internal/constants"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var knownProtocols = []string{"dlna", "ftp", "http", "nfs", "restic", "s3", "sftp", "webdav"}
+
+// Flags the manager sets or depends on itself. --daemon would detach rclone
+// from the process the manager supervises.
+var (
+	managedMountFlags = []string{"allow-non-empty", "daemon"}
+	managedServeFlags = []string{"addr", "daemon"}
+	// managedFlagHints tell what to set instead of a managed flag
+	managedFlagHints = map[string]string{
+		"allow-non-empty": ", set allowNonEmpty instead",
+	}
+)
+
+type Problem struct {
+	Line    int
+	Field   string
+	Message string
+}
+
+func (p Problem) String() string {
+	var b strings.Builder
+	if p.Line > 0 {
+		fmt.Fprintf(&b, "line %d: ", p.Line)
+	}
+	if p.Field != "" {
+		fmt.Fprintf(&b, "%s: ", p.Field)
+	}
+	b.WriteString(p.Message)
+	return b.String()
+}
+
+type ValidationError struct {
+	Revision string
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid config (revision %s): %s", e.Revision, strings.Join(e.Messages(), "; "))
+}
+
+func (e *ValidationError) Messages() []string {
+	messages := make([]string, 0, len(e.Problems))
+	for _, problem := range e.Problems {
+		messages = append(messages, problem.String())
+	}
+	return messages
+}
+
+type validator struct {
+	problems []Problem
+}
+
+func (v *validator) add(line int, field, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{Line: line, Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate collects every problem in the config rather than stopping at the first.
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	if c.Mode != constants.ModeProcess && c.Mode != constants.ModeRcd {
+		v.add(c.pos.lineOf("mode"), "mode", "unknown mode %q, expected %q or %q", c.Mode, constants.ModeProcess, constants.ModeRcd)
+	}
+
+	if c.Rcd.Addr != "" && !strings.HasPrefix(c.Rcd.Addr, "unix://") && !strings.HasPrefix(c.Rcd.Addr, "/") {
+		if err := validateAddr(c.Rcd.Addr); err != nil {
+			v.add(c.Rcd.pos.lineOf("addr"), "rcd.addr", "%v", err)
+		}
+	}
+
+	validateRestart(v, c.Restart, "restart")
+	validateTimeout(v, c.StopTimeout, "stopTimeout", "", c.pos)
+	validateTimeout(v, c.ShutdownTimeout, "shutdownTimeout", "", c.pos)
+	validateOnBusy(v, c.OnBusy, c.BusyTimeout, "", c.pos)
+	validatePropagationCheck(v, c.PropagationCheck, "", c.pos)
+
+	for i, root := range c.OrphanMounts.Roots {
+		if !filepath.IsAbs(root) {
+			v.add(c.OrphanMounts.pos.lineOf("roots"), fmt.Sprintf("orphanMounts.roots[%d]", i), "must be an absolute path, got %q", root)
+		}
+	}
+
+	names := make(map[string]string)
+	checkName := func(name, field string, line int) {
+		if previous, ok := names[name]; ok {
+			v.add(line, field, "duplicate name %q, already used by %s", name, previous)
+			return
+		}
+		names[name] = field
+	}
+
+	mountPoints := make(map[string]string)
+	for i, mount := range c.Mounts {
+		field := fmt.Sprintf("mounts[%d]", i)
+		checkName(mount.Name, field+".name", mount.pos.lineOf("name"))
+		validateBackendName(v, mount.BackendName, field, mount.pos)
+
+		validateRemotePath(v, mount.RemotePath, field, mount.pos)
+		if mount.Restart.pos.line > 0 {
+			validateRestart(v, mount.Restart, field+".restart")
+		}
+		validateExtraArgs(v, mount.Args, mount.Flags, managedMountFlags, field, mount.pos)
+		validateTimeout(v, mount.StopTimeout, "stopTimeout", field+".", mount.pos)
+		validateOnBusy(v, mount.OnBusy, mount.BusyTimeout, field+".", mount.pos)
+		validateOwnership(v, mount, field+".")
+		validatePropagationCheck(v, mount.PropagationCheck, field+".", mount.pos)
+		validateMountProbe(v, mount.Probe, field+".probe")
+		validateProcessOnly(v, c.Mode, mount.pos, field+".", "environment", "args", "flags", "probe")
+
+		switch {
+		case mount.MountPoint == "":
+			v.add(mount.pos.lineOf("mountPoint"), field+".mountPoint", "must not be empty")
+		case !filepath.IsAbs(mount.MountPoint):
+			v.add(mount.pos.lineOf("mountPoint"), field+".mountPoint", "must be an absolute path, got %q", mount.MountPoint)
+		default:
+			cleaned := filepath.Clean(mount.MountPoint)
+			if previous, ok := mountPoints[cleaned]; ok {
+				v.add(mount.pos.lineOf("mountPoint"), field+".mountPoint", "duplicate mount point %q, already used by %s", mount.MountPoint, previous)
+			} else {
+				mountPoints[cleaned] = field
+			}
+		}
+	}
+
+	var listeners []listener
+	for i, serve := range c.Serves {
+		field := fmt.Sprintf("serves[%d]", i)
+		checkName(serve.Name, field+".name", serve.pos.lineOf("name"))
+		validateBackendName(v, serve.BackendName, field, serve.pos)
+
+		validateRemotePath(v, serve.RemotePath, field, serve.pos)
+		if serve.Restart.pos.line > 0 {
+			validateRestart(v, serve.Restart, field+".restart")
+		}
+		validateExtraArgs(v, serve.Args, serve.Flags, managedServeFlags, field, serve.pos)
+		validateTimeout(v, serve.StopTimeout, "stopTimeout", field+".", serve.pos)
+		validateProbe(v, serve.Probe, field+".probe")
+		validateProcessOnly(v, c.Mode, serve.pos, field+".", "environment", "args", "flags", "probe")
+
+		if !slices.Contains(knownProtocols, serve.Protocol) {
+			v.add(serve.pos.lineOf("protocol"), field+".protocol", "unknown protocol %q, expected one of %s", serve.Protocol, strings.Join(knownProtocols, ", "))
+		}
+
+		if err := validateAddr(serve.Addr); err != nil {
+			v.add(serve.pos.lineOf("addr"), field+".addr", "%v", err)
+		} else if previous, ok := conflictingListener(listeners, serve.Addr); ok {
+			v.add(serve.pos.lineOf("addr"), field+".addr", "duplicate addr %q, %s already listens on %q", serve.Addr, previous.field, previous.addr)
+		} else {
+			listeners = append(listeners, listener{addr: serve.Addr, field: field})
+		}
+	}
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Revision: c.Revision, Problems: v.problems}
+	}
+	return nil
+}
+
+func validateBackendName(v *validator, backendName, field string, pos position) {
+	switch {
+	case backendName == "":
+		v.add(pos.lineOf("backendName"), field+".backendName", "must not be empty")
+	case strings.ContainsAny(backendName, ": \t"):
+		v.add(pos.lineOf("backendName"), field+".backendName", "must be a remote name without ':' or whitespace, got %q", backendName)
+	}
+}
+
+func validateRestart(v *validator, restart RestartConfig, field string) {
+	pos := restart.pos
+	switch restart.Policy {
+	case constants.RestartAlways, constants.RestartOnFailure, constants.RestartNever:
+	default:
+		v.add(pos.lineOf("policy"), field+".policy", "unknown policy %q, expected %s, %s or %s",
+			restart.Policy, constants.RestartAlways, constants.RestartOnFailure, constants.RestartNever)
+	}
+
+	durations := []struct {
+		key   string
+		value time.Duration
+	}{
+		{"initialBackoff", restart.InitialBackoff},
+		{"maxBackoff", restart.MaxBackoff},
+		{"window", restart.Window},
+		{"gracePeriod", restart.GracePeriod},
+		{"coolDown", restart.CoolDown},
+	}
+	for _, duration := range durations {
+		if duration.value < 0 {
+			v.add(pos.lineOf(duration.key), field+"."+duration.key, "must not be negative, got %s", duration.value)
+		}
+	}
+	if restart.InitialBackoff > restart.MaxBackoff {
+		v.add(pos.lineOf("initialBackoff"), field+".initialBackoff", "must not be larger than maxBackoff (%s)", restart.MaxBackoff)
+	}
+	if restart.Jitter != nil && (*restart.Jitter < 0 || *restart.Jitter > 1) {
+		v.add(pos.lineOf("jitter"), field+".jitter", "must be between 0 and 1, got %v", *restart.Jitter)
+	}
+	if restart.MaxRestarts != nil && *restart.MaxRestarts < 0 {
+		v.add(pos.lineOf("maxRestarts"), field+".maxRestarts", "must not be negative, 0 means unlimited")
+	}
+}
+
+func validateProbe(v *validator, probe ProbeConfig, field string) {
+	pos := probe.pos
+	switch probe.Type {
+	case constants.ProbeTCP, constants.ProbeHTTP, constants.ProbeSSH:
+	default:
+		v.add(pos.lineOf("type"), field+".type", "unknown probe type %q, expected %s, %s or %s",
+			probe.Type, constants.ProbeTCP, constants.ProbeHTTP, constants.ProbeSSH)
+	}
+
+	if !strings.HasPrefix(probe.Path, "/") {
+		v.add(pos.lineOf("path"), field+".path", "must start with '/', got %q", probe.Path)
+	}
+	for i, status := range probe.ExpectStatus {
+		if status < 100 || status > 599 {
+			v.add(pos.lineOf("expectStatus"), fmt.Sprintf("%s.expectStatus[%d]", field, i), "invalid HTTP status %d", status)
+		}
+	}
+	if len(probe.ExpectStatus) > 0 && probe.Type != constants.ProbeHTTP {
+		v.add(pos.lineOf("expectStatus"), field+".expectStatus", "only applies to %s probes", constants.ProbeHTTP)
+	}
+
+	validateTimeout(v, probe.InitialDelay, "initialDelay", field+".", pos)
+	validateTimeout(v, probe.Period, "period", field+".", pos)
+	validateTimeout(v, probe.Timeout, "timeout", field+".", pos)
+	validateTimeout(v, probe.StartupTimeout, "startupTimeout", field+".", pos)
+	if probe.FailureThreshold < 0 {
+		v.add(pos.lineOf("failureThreshold"), field+".failureThreshold", "must not be negative, got %d", probe.FailureThreshold)
+	}
+}
+
+// validateProcessOnly rejects keys that only process mode acts on, as rcd runs
+// every mount and serve inside its own process.
+func validateProcessOnly(v *validator, mode string, pos position, prefix string, keys ...string) {
+	if mode != constants.ModeRcd {
+		return
+	}
+	for _, key := range keys {
+		if pos.has(key) {
+			v.add(pos.lineOf(key), prefix+key, "only applies in %q mode", constants.ModeProcess)
+		}
+	}
+}
+
+func validateMountProbe(v *validator, probe MountProbeConfig, field string) {
+	pos := probe.pos
+	validateTimeout(v, probe.Period, "period", field+".", pos)
+	validateTimeout(v, probe.Timeout, "timeout", field+".", pos)
+	validateTimeout(v, probe.StartupTimeout, "startupTimeout", field+".", pos)
+	if probe.FailureThreshold < 0 {
+		v.add(pos.lineOf("failureThreshold"), field+".failureThreshold", "must not be negative, got %d", probe.FailureThreshold)
+	}
+}
+
+func validateOnBusy(v *validator, onBusy string, busyTimeout time.Duration, prefix string, pos position) {
+	switch onBusy {
+	case constants.OnBusyWait, constants.OnBusyLazy, constants.OnBusyRefuse:
+	default:
+		v.add(pos.lineOf("onBusy"), prefix+"onBusy", "unknown policy %q, expected %s, %s or %s",
+			onBusy, constants.OnBusyWait, constants.OnBusyLazy, constants.OnBusyRefuse)
+	}
+	validateTimeout(v, busyTimeout, "busyTimeout", prefix, pos)
+}
+
+func validatePropagationCheck(v *validator, check string, prefix string, pos position) {
+	switch check {
+	case constants.PropagationCheckOff, constants.PropagationCheckWarn, constants.PropagationCheckFail:
+	default:
+		v.add(pos.lineOf("propagationCheck"), prefix+"propagationCheck", "unknown value %q, expected %s, %s or %s",
+			check, constants.PropagationCheckOff, constants.PropagationCheckWarn, constants.PropagationCheckFail)
+	}
+}
+
+func validateOwnership(v *validator, mount Mount, prefix string) {
+	if mount.DirMode != "" {
+		if _, err := ParseMode(mount.DirMode); err != nil {
+			v.add(mount.pos.lineOf("dirMode"), prefix+"dirMode", "%v", err)
+		}
+	}
+	if mount.Owner != "" {
+		if err := checkAccount(mount.Owner); err != nil {
+			v.add(mount.pos.lineOf("owner"), prefix+"owner", "%v", err)
+		}
+	}
+	if mount.Group != "" {
+		if err := checkAccount(mount.Group); err != nil {
+			v.add(mount.pos.lineOf("group"), prefix+"group", "%v", err)
+		}
+	}
+}
+
+func validateTimeout(v *validator, timeout time.Duration, key, prefix string, pos position) {
+	if timeout < 0 {
+		v.add(pos.lineOf(key), prefix+key, "must not be negative, got %s", timeout)
+	}
+}
+
+func validateRemotePath(v *validator, remotePath, field string, pos position) {
+	if remotePath == "" {
+		return
+	}
+	line := pos.lineOf("remotePath")
+	field += ".remotePath"
+
+	if strings.IndexFunc(remotePath, unicode.IsControl) >= 0 {
+		v.add(line, field, "must not contain control characters")
+		return
+	}
+	for _, segment := range strings.Split(remotePath, "/") {
+		if segment == ".." {
+			v.add(line, field, "must not contain '..', got %q", remotePath)
+			return
+		}
+	}
+	if strings.HasPrefix(remotePath, ":") {
+		v.add(line, field, "is the path within the remote, without the remote name or ':', got %q", remotePath)
+	}
+}
+
+func validateExtraArgs(v *validator, args []string, flags Flags, managed []string, field string, pos position) {
+	for i, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if name := FlagName(arg); slices.Contains(managed, name) {
+			v.add(pos.lineOf("args"), fmt.Sprintf("%s.args[%d]", field, i), "--%s is controlled by rclone-manager and cannot be set%s", name, managedFlagHints[name])
+		}
+	}
+
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		flagName := FlagName(name)
+		switch {
+		case flagName == "" || strings.ContainsAny(flagName, " \t"):
+			v.add(pos.lineOf("flags"), fmt.Sprintf("%s.flags", field), "invalid flag name %q", name)
+		case strings.Contains(name, "="):
+			v.add(pos.lineOf("flags"), fmt.Sprintf("%s.flags.%s", field, name), "flag name must not contain '=', set the value instead")
+		case slices.Contains(managed, flagName):
+			v.add(pos.lineOf("flags"), fmt.Sprintf("%s.flags.%s", field, name), "--%s is controlled by rclone-manager and cannot be set%s", flagName, managedFlagHints[flagName])
+		}
+	}
+}
+
+func validateAddr(addr string) error {
+	if addr == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid addr %q: %v", addr, err)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 0 || portNumber > 65535 {
+		return fmt.Errorf("invalid port %q in addr %q", port, addr)
+	}
+	return nil
+}
+
+type listener struct {
+	addr  string
+	field string
+}
+
+// conflictingListener returns an earlier listener on the same port as addr
+// and an overlapping host, where an empty or unspecified host listens on every
+// interface, so ":8080" and "0.0.0.0:8080" collide. Port 0 picks a free port.
+func conflictingListener(listeners []listener, addr string) (listener, bool) {
+	host, port, _ := net.SplitHostPort(addr)
+	if port == "0" {
+		return listener{}, false
+	}
+	for _, previous := range listeners {
+		previousHost, previousPort, _ := net.SplitHostPort(previous.addr)
+		if previousPort == port && sameInterface(host, previousHost) {
+			return previous, true
+		}
+	}
+	return listener{}, false
+}
+
+func sameInterface(a, b string) bool {
+	if anyInterface(a) || anyInterface(b) || a == b {
+		return true
+	}
+	aIP, bIP := net.ParseIP(a), net.ParseIP(b)
+	return aIP != nil && aIP.Equal(bIP)
+}
+
+func anyInterface(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// CheckRemotes reports backends for which defined returns false. They are
+// warnings rather than validation errors, since rclone can also pick remotes
+// up from RCLONE_CONFIG_* environment variables.
+func (c *Config) CheckRemotes(defined func(backendName string) bool) []Problem {
+	var problems []Problem
+	for i, mount := range c.Mounts {
+		if mount.BackendName != "" && !defined(mount.BackendName) {
+			problems = append(problems, Problem{
+				Line:    mount.pos.lineOf("backendName"),
+				Field:   fmt.Sprintf("mounts[%d].backendName", i),
+				Message: fmt.Sprintf("remote %q is not defined", mount.BackendName),
+			})
+		}
+	}
+	for i, serve := range c.Serves {
+		if serve.BackendName != "" && !defined(serve.BackendName) {
+			problems = append(problems, Problem{
+				Line:    serve.pos.lineOf("backendName"),
+				Field:   fmt.Sprintf("serves[%d].backendName", i),
+				Message: fmt.Sprintf("remote %q is not defined", serve.BackendName),
+			})
+		}
+	}
+	return problems
+}
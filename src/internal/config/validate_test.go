@@ -0,0 +1,157 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func load(t *testing.T, yaml string) error {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadConfigFromFile(path)
+	return err
+}
+
+func TestValidateReportsProblems(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want []Problem
+	}{
+		{
+			name: "duplicate name across a mount and a serve",
+			yaml: `mounts:
+  - name: media
+    backendName: A
+    mountPoint: /mnt/a
+serves:
+  - name: media
+    backendName: A
+    protocol: webdav
+    addr: :8080
+`,
+			want: []Problem{{Line: 6, Field: "serves[0].name", Message: `duplicate name "media", already used by mounts[0].name`}},
+		},
+		{
+			name: "default names of the same serve twice",
+			yaml: `serves:
+  - backendName: A
+    protocol: webdav
+    addr: 127.0.0.1:8080
+  - backendName: A
+    protocol: webdav
+    addr: 127.0.0.1:8080
+`,
+			// A default name is reported at the entry it belongs to
+			want: []Problem{
+				{Line: 5, Field: "serves[1].name", Message: `duplicate name "A-webdav@127.0.0.1:8080", already used by serves[0].name`},
+				{Line: 7, Field: "serves[1].addr", Message: `duplicate addr "127.0.0.1:8080", serves[0] already listens on "127.0.0.1:8080"`},
+			},
+		},
+		{
+			name: "every interface overlaps a single one",
+			yaml: `serves:
+  - backendName: A
+    protocol: webdav
+    addr: 127.0.0.1:8080
+  - backendName: B
+    protocol: http
+    addr: :8080
+`,
+			want: []Problem{{Line: 7, Field: "serves[1].addr", Message: `duplicate addr ":8080", serves[0] already listens on "127.0.0.1:8080"`}},
+		},
+		{
+			name: "unspecified and empty host overlap",
+			yaml: `serves:
+  - backendName: A
+    protocol: webdav
+    addr: 0.0.0.0:8080
+  - backendName: B
+    protocol: http
+    addr: "[::]:8080"
+`,
+			want: []Problem{{Line: 7, Field: "serves[1].addr", Message: `duplicate addr "[::]:8080", serves[0] already listens on "0.0.0.0:8080"`}},
+		},
+		{
+			name: "docker has no addr",
+			yaml: `serves:
+  - backendName: A
+    protocol: docker
+    addr: :8080
+`,
+			want: []Problem{{Line: 3, Field: "serves[0].protocol", Message: `unknown protocol "docker", expected one of dlna, ftp, http, nfs, restic, s3, sftp, webdav`}},
+		},
+		{
+			name: "problems are reported at their lines",
+			yaml: `mode: process
+restart:
+  policy: sometimes
+mounts:
+  - backendName: "A:"
+    mountPoint: relative
+    onBusy: maybe
+`,
+			want: []Problem{
+				{Line: 3, Field: "restart.policy", Message: `unknown policy "sometimes", expected always, on-failure or never`},
+				{Line: 5, Field: "mounts[0].backendName", Message: `must be a remote name without ':' or whitespace, got "A:"`},
+				{Line: 7, Field: "mounts[0].onBusy", Message: `unknown policy "maybe", expected wait, lazy or refuse`},
+				{Line: 6, Field: "mounts[0].mountPoint", Message: `must be an absolute path, got "relative"`},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := load(t, test.yaml)
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("err = %v, want a validation error", err)
+			}
+			got := validationErr.Problems
+			if len(got) != len(test.want) {
+				t.Fatalf("problems = %q, want %q", validationErr.Messages(), test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("problem %d = %q, want %q", i, got[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidateAcceptsDistinctListeners(t *testing.T) {
+	err := load(t, `serves:
+  - backendName: A
+    protocol: webdav
+    addr: 127.0.0.1:8080
+  - backendName: A
+    protocol: http
+    addr: 127.0.0.2:8080
+  - backendName: A
+    protocol: ftp
+    addr: 127.0.0.1:0
+  - backendName: B
+    protocol: ftp
+    addr: :0
+`)
+	if err != nil {
+		t.Fatalf("err = %v, want none", err)
+	}
+}
+
+func TestProblemString(t *testing.T) {
+	problem := Problem{Line: 4, Field: "serves[0].addr", Message: "must not be empty"}
+	if got := problem.String(); got != "line 4: serves[0].addr: must not be empty" {
+		t.Errorf("String() = %q", got)
+	}
+	if got := (Problem{Message: "yaml: bad"}).String(); !strings.HasPrefix(got, "yaml") {
+		t.Errorf("String() = %q, want no line or field", got)
+	}
+}
@@ -1,28 +1,140 @@
 package constants
 
+import "time"
+
 // Constants for rclone
 const (
 	Serve      = "serve"
 	Mount      = "mount"
 	MountPoint = "mountPoint="
 	Addr       = "--addr"
+	Rcd        = "rcd"
+	RcAddr     = "--rc-addr"
+	RcUser     = "--rc-user"
+	RcPass     = "--rc-pass"
+	RcNoAuth   = "--rc-no-auth"
+
+	AllowNonEmpty = "--allow-non-empty"
+)
+
+// Constants for restart policies
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+	RestartNever     = "never"
+)
+
+// Constants for unit states
+const (
+	StatePending  = "pending"
+	StateStarting = "starting"
+	StateReady    = "ready"
+	StateDegraded = "degraded"
+	StateStopping = "stopping"
+	StateStopped  = "stopped"
+	StateFailed   = "failed"
 )
 
-// Constants for fusermount
+// Constants for what happens when a mount to unmount is busy
 const (
-	Fusermount  = "fusermount"
-	FuseUnmount = "-uz"
+	OnBusyWait   = "wait"
+	OnBusyLazy   = "lazy"
+	OnBusyRefuse = "refuse"
 )
 
+// Constants for mount propagation types and for what happens when a mount
+// point is not on a shared filesystem
+const (
+	PropagationShared     = "shared"
+	PropagationSlave      = "slave"
+	PropagationPrivate    = "private"
+	PropagationUnbindable = "unbindable"
+
+	PropagationCheckOff  = "off"
+	PropagationCheckWarn = "warn"
+	PropagationCheckFail = "fail"
+)
+
+// Constants for serve probe types
+const (
+	ProbeTCP  = "tcp"
+	ProbeHTTP = "http"
+	ProbeSSH  = "ssh"
+)
+
+// Constants for circuit breaker states
+const (
+	BreakerClosed = "closed"
+	BreakerOpen   = "open"
+)
+
+// RcdResyncInterval is how often the mounts and serves of a running rcd are
+// compared with the config
+const RcdResyncInterval = 10 * time.Second
+
+// Readiness checks of supervised units. A starting unit is checked every
+// StartupCheckInterval until it is ready, a ready one every ReadyCheckInterval.
+// Checks slower than SlowCheckThreshold are logged.
+const (
+	StartupCheckInterval = 1 * time.Second
+	ReadyCheckInterval   = 15 * time.Second
+	ReadyCheckTimeout    = 5 * time.Second
+	SlowCheckThreshold   = 1 * time.Second
+)
+
+// Constants for manager modes
+const (
+	ModeProcess = "process"
+	ModeRcd     = "rcd"
+)
+
+// FsTypeRclone is the type of an rclone FUSE mount in mountinfo
+const FsTypeRclone = "fuse.rclone"
+
 // Log constants
 const (
-	LogBackend    = "backend"
-	LogMountPoint = "mountPoint"
-	LogAddr       = "addr"
-	LogProtocol   = "protocol"
-	LogError      = "error"
-	LogPid        = "pid"
-	LogFile       = "file"
+	LogName           = "name"
+	LogBackend        = "backend"
+	LogMountPoint     = "mountPoint"
+	LogAddr           = "addr"
+	LogProtocol       = "protocol"
+	LogError          = "error"
+	LogPid            = "pid"
+	LogFile           = "file"
+	LogChanges        = "changes"
+	LogRemotes        = "remotes"
+	LogCount          = "count"
+	LogRevision       = "revision"
+	LogKeptRevision   = "keptRevision"
+	LogErrors         = "errors"
+	LogMode           = "mode"
+	LogServeId        = "serveId"
+	LogBackoff        = "backoff"
+	LogRestarts       = "restarts"
+	LogPolicy         = "policy"
+	LogState          = "state"
+	LogUntil          = "until"
+	LogWindow         = "window"
+	LogTimeout        = "timeout"
+	LogPendingUploads = "pendingUploads"
+	LogFs             = "fs"
+	LogExitCode       = "exitCode"
+	LogSignal         = "signal"
+	LogKind           = "kind"
+	LogLatency        = "latency"
+	LogFailures       = "failures"
+	LogRoots          = "roots"
+	LogSource         = "source"
+	LogMountPoints    = "mountPoints"
+	LogCommand        = "command"
+	LogPaths          = "paths"
+	LogOnBusy         = "onBusy"
+	LogFsType         = "fsType"
+	LogDirMode        = "dirMode"
+	LogOwner          = "owner"
+	LogGroup          = "group"
+	LogPropagation    = "propagation"
+	LogFilesystem     = "filesystem"
 )
 
 // Constants data files
@@ -35,4 +147,17 @@ const (
 
 	RcloneBinaryNameEnvVar  = "RCLONE_MANAGER_RCLONE_BIN_NAME"
 	DefaultRcloneBinaryName = "rclone"
+
+	StatusFileEnvVar = "RCLONE_MANAGER_STATUS_FILE"
+
+	WatchQuietPeriodEnvVar  = "RCLONE_MANAGER_WATCH_QUIET_PERIOD"
+	DefaultWatchQuietPeriod = 2 * time.Second
+
+	MountinfoEnvVar  = "RCLONE_MANAGER_MOUNTINFO"
+	DefaultMountinfo = "/proc/self/mountinfo"
+
+	RcAddrEnvVar  = "RCLONE_RC_ADDR"
+	DefaultRcAddr = "localhost:5572"
+
+	AllowNonEmptyEnvVar = "RCLONE_ALLOW_NON_EMPTY"
 )
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 )
 
 func PrepareEnvironment(envVars map[string]string) []string {
@@ -33,6 +34,14 @@ func GetEnvWithFallback(key, defaultValue string) string {
 	return value
 }
 
+func GetDurationEnvWithFallback(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
 func splitEnv(env string) []string {
 	parts := make([]string, 2)
 	idx := strings.Index(env, "=")
@@ -0,0 +1,117 @@
+package instance_tracker
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ExitEvent reports that a process exited, or never started. Cmd tells events
+// of a unit's current process apart from those of one it already replaced.
+type ExitEvent struct {
+	Name     string
+	Cmd      *exec.Cmd
+	Err      error
+	ExitCode int
+	Signal   string
+}
+
+// ExitEvents delivers the exit events of every watched process until ctx is
+// done, and keeps track of the goroutines publishing them.
+type ExitEvents struct {
+	ctx    context.Context
+	events chan ExitEvent
+	wg     sync.WaitGroup
+}
+
+func NewExitEvents(ctx context.Context) *ExitEvents {
+	return &ExitEvents{ctx: ctx, events: make(chan ExitEvent)}
+}
+
+func (e *ExitEvents) C() <-chan ExitEvent {
+	return e.events
+}
+
+// Wait waits up to timeout for every watched process to be reaped, and
+// reports whether they all were.
+func (e *ExitEvents) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// publish runs f in a goroutine that is waited for, and delivers the event it
+// returns.
+func (e *ExitEvents) publish(f func() ExitEvent) {
+	e.run(func() {
+		e.send(f())
+	})
+}
+
+// run runs f in a goroutine that is waited for.
+func (e *ExitEvents) run(f func()) {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		f()
+	}()
+}
+
+// send delivers event unless nobody listens anymore.
+func (e *ExitEvents) send(event ExitEvent) {
+	select {
+	case e.events <- event:
+	case <-e.ctx.Done():
+	}
+}
+
+func NewExitEvent(name string, cmd *exec.Cmd, err error) ExitEvent {
+	event := ExitEvent{Name: name, Cmd: cmd, Err: err, ExitCode: -1}
+
+	var exitErr *exec.ExitError
+	if err == nil {
+		event.ExitCode = 0
+	} else if errors.As(err, &exitErr) {
+		event.ExitCode = exitErr.ExitCode()
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			event.Signal = status.Signal().String()
+		}
+	}
+	return event
+}
+
+// Matches reports whether the event is about the process p currently runs.
+func (p *RcloneProcess) Matches(event ExitEvent) bool {
+	return p.Command != nil && p.Command == event.Cmd
+}
+
+// StartFailed records that the process could not be started, and reports it
+// like an exit so it is retried according to the restart policy.
+func (p *RcloneProcess) StartFailed(cmd *exec.Cmd, err error, events *ExitEvents) {
+	p.PID = 0
+	p.StartedAt = time.Now()
+	name := p.Name
+	events.publish(func() ExitEvent {
+		return NewExitEvent(name, cmd, err)
+	})
+}
+
+// Earliest returns the earlier of two times, where the zero time means never.
+func Earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
@@ -2,14 +2,22 @@ package instance_tracker
 
 import (
 	"os/exec"
+	"rclone-manager/internal/config"
+	"rclone-manager/internal/spec"
 	"time"
 )
 
 type RcloneProcess struct {
+	Name        string
 	PID         int
 	Command     *exec.Cmd
 	BackendName string
 	StartedAt   time.Time
-	GracePeriod time.Duration
+	StopTimeout time.Duration
 	Environment map[string]string
+	Spec        *spec.Spec
+	Restart     config.RestartConfig
+	RestartState
+
+	done chan struct{}
 }
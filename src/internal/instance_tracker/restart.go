@@ -0,0 +1,168 @@
+package instance_tracker
+
+import (
+	"github.com/rs/zerolog"
+	"math"
+	"math/rand"
+	"rclone-manager/internal/circuit_breaker"
+	"rclone-manager/internal/config"
+	"rclone-manager/internal/constants"
+	"time"
+)
+
+type RestartState struct {
+	Failures    int
+	Restarts    []time.Time
+	NextAttempt time.Time
+	GaveUp      bool
+	State       string
+	Exited      bool
+	ExitErr     error
+}
+
+// ScheduleRestart decides, once a process is found down, whether and when the
+// restart policy allows it to be started again. It returns false when the
+// policy says the process should stay down.
+func (p *RcloneProcess) ScheduleRestart(now time.Time) (time.Time, bool) {
+	policy := p.Restart
+
+	switch policy.Policy {
+	case constants.RestartNever:
+		p.GaveUp = true
+		p.State = constants.StateStopped
+		return time.Time{}, false
+	case constants.RestartOnFailure:
+		// A clean exit right after starting is still a failure to start
+		if p.Exited && p.ExitErr == nil && now.Sub(p.StartedAt) >= policy.GracePeriod {
+			p.GaveUp = true
+			p.State = constants.StateStopped
+			return time.Time{}, false
+		}
+	}
+
+	// A process that stayed up for as long as the longest backoff recovered,
+	// so the next failure starts from the initial backoff again
+	if !p.StartedAt.IsZero() && p.PID != 0 && now.Sub(p.StartedAt) >= policy.MaxBackoff {
+		p.Failures = 0
+	}
+
+	p.NextAttempt = now.Add(Backoff(policy, p.Failures))
+	p.Failures++
+	p.State = constants.StatePending
+	return p.NextAttempt, true
+}
+
+// HandleExit schedules a restart of the process according to its restart policy,
+// once its exit event arrived.
+func (p *RcloneProcess) HandleExit(event ExitEvent, now time.Time, logger zerolog.Logger) {
+	p.Exited = true
+	p.ExitErr = event.Err
+
+	next, ok := p.ScheduleRestart(now)
+	if !ok {
+		logger.Error().Str(constants.LogName, p.Name).
+			Str(constants.LogPolicy, p.Restart.Policy).
+			Int(constants.LogExitCode, event.ExitCode).
+			Str(constants.LogSignal, event.Signal).
+			Msg("Process is down, not restarting due to restart policy")
+		return
+	}
+	logger.Warn().Str(constants.LogName, p.Name).
+		Int(constants.LogExitCode, event.ExitCode).
+		Str(constants.LogSignal, event.Signal).
+		Dur(constants.LogBackoff, next.Sub(now)).
+		Int(constants.LogRestarts, len(p.Restarts)).
+		Msg("Process is down, scheduling restart")
+}
+
+// Due reports whether a scheduled restart of the process should happen now,
+// and records it. Otherwise it returns when to check again, where the zero
+// time means no restart is pending.
+func (p *RcloneProcess) Due(now time.Time, breakers *circuit_breaker.Breakers, logger zerolog.Logger) (time.Time, bool) {
+	if p.NextAttempt.IsZero() {
+		return time.Time{}, false
+	}
+	if now.Before(p.NextAttempt) {
+		return p.NextAttempt, false
+	}
+	if until, ok := p.AllowRestart(now, breakers, logger); !ok {
+		return until, false
+	}
+	p.RecordRestart(now)
+	return time.Time{}, true
+}
+
+// AllowRestart is consulted once NextAttempt is reached. It holds the process
+// back while the circuit breaker of its backend is open, returning until when,
+// and trips the breaker when the backend has been restarted too often within
+// the window.
+func (p *RcloneProcess) AllowRestart(now time.Time, breakers *circuit_breaker.Breakers, logger zerolog.Logger) (time.Time, bool) {
+	backend := p.breakerKey()
+
+	if until, open := breakers.IsOpen(backend, now); open {
+		if p.State != constants.StateFailed {
+			p.State = constants.StateFailed
+			logger.Warn().Str(constants.LogName, p.Name).
+				Str(constants.LogBackend, backend).
+				Time(constants.LogUntil, until).
+				Msg("Circuit breaker of backend is open, holding restart")
+		}
+		return until, false
+	}
+
+	if p.State == constants.StateFailed {
+		logger.Info().Str(constants.LogName, p.Name).
+			Str(constants.LogBackend, backend).
+			Msg("Circuit breaker of backend closed, resuming restarts")
+		p.Failures = 0
+	}
+
+	if until, tripped := breakers.Record(backend, now, p.Restart); tripped {
+		p.State = constants.StateFailed
+		logger.Error().Str(constants.LogName, p.Name).
+			Str(constants.LogBackend, backend).
+			Int(constants.LogRestarts, *p.Restart.MaxRestarts).
+			Dur(constants.LogWindow, p.Restart.Window).
+			Time(constants.LogUntil, until).
+			Msg("Crash loop detected, circuit breaker of backend is open and restarts are held until the cool-down expires or it is reset")
+		return until, false
+	}
+	return time.Time{}, true
+}
+
+func (p *RcloneProcess) RecordRestart(now time.Time) {
+	p.Restarts = append(pruneBefore(p.Restarts, now.Add(-p.Restart.Window)), now)
+	p.NextAttempt = time.Time{}
+}
+
+// Backoff doubles the initial backoff for every consecutive failure, up to the
+// max backoff, and spreads it by +/- jitter.
+func Backoff(policy config.RestartConfig, failures int) time.Duration {
+	backoff := float64(policy.InitialBackoff) * math.Pow(2, float64(failures))
+	if backoff > float64(policy.MaxBackoff) {
+		backoff = float64(policy.MaxBackoff)
+	}
+	if jitter := *policy.Jitter; jitter > 0 {
+		backoff *= 1 + jitter*(rand.Float64()*2-1)
+	}
+	return time.Duration(backoff)
+}
+
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	kept := times[:0]
+	for _, t := range times {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// breakerKey shares the breaker between every unit of a backend. Processes
+// without a backend, like rcd, get a breaker of their own.
+func (p *RcloneProcess) breakerKey() string {
+	if p.BackendName != "" {
+		return p.BackendName
+	}
+	return p.Name
+}
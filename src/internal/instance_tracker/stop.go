@@ -0,0 +1,193 @@
+package instance_tracker
+
+import (
+	"context"
+	"errors"
+	"github.com/rs/zerolog"
+	"os"
+	"os/exec"
+	"rclone-manager/internal/constants"
+	"rclone-manager/internal/rcclient"
+	"syscall"
+	"time"
+)
+
+// reapTimeout bounds the wait for a killed process to be reaped, a process
+// stuck in the kernel on a hung FUSE mount may never be. pendingUploadsTimeout
+// keeps an unresponsive RC API from eating into the stop timeout.
+const (
+	reapTimeout           = 2 * time.Second
+	pendingUploadsTimeout = 2 * time.Second
+)
+
+var errNotReaped = errors.New("process was killed but not reaped")
+
+// Watch waits for the process started by cmd in the background, calls onExit
+// and then publishes the exit on events. Only the supervisor, which receives
+// the event, records the exit on p.
+func (p *RcloneProcess) Watch(cmd *exec.Cmd, events *ExitEvents, onExit func(event ExitEvent)) {
+	done := make(chan struct{})
+	p.done = done
+	name := p.Name
+	events.publish(func() ExitEvent {
+		err := cmd.Wait()
+		close(done)
+
+		event := NewExitEvent(name, cmd, err)
+		onExit(event)
+		return event
+	})
+}
+
+// TimeoutWithin shortens timeout so that a stop started now ends by deadline.
+func TimeoutWithin(timeout time.Duration, deadline time.Time) time.Duration {
+	return max(min(timeout, time.Until(deadline)), 0)
+}
+
+// Shutdown stops the process within timeout and logs how that went. When the
+// process serves the RC API, the uploads it still had pending are reported, as
+// those are lost if it has to be killed. It gives up waiting for the process
+// once ctx is done and returns the error of ctx, leaving the process to exit
+// on the SIGTERM it got or to be stopped again.
+func (p *RcloneProcess) Shutdown(ctx context.Context, timeout time.Duration, logger zerolog.Logger) error {
+	pending, known := p.pendingUploads(ctx)
+	if known && pending > 0 {
+		logger.Warn().Str(constants.LogName, p.Name).
+			Int64(constants.LogPendingUploads, pending).
+			Dur(constants.LogTimeout, timeout).
+			Msg("Uploads are still pending, giving rclone time to finish them")
+	}
+
+	killed, err := p.Stop(ctx, timeout)
+	switch {
+	case err != nil && err == ctx.Err():
+		logger.Warn().AnErr(constants.LogError, err).Int(constants.LogPid, p.PID).Str(constants.LogName, p.Name).
+			Msg("Gave up waiting for process to stop")
+		return err
+	case err != nil:
+		logger.Warn().AnErr(constants.LogError, err).Int(constants.LogPid, p.PID).Str(constants.LogName, p.Name).Msg("Failed to stop process")
+	case killed && known && pending > 0:
+		logger.Error().Int(constants.LogPid, p.PID).Str(constants.LogName, p.Name).
+			Int64(constants.LogPendingUploads, pending).
+			Msg("Process did not exit in time and was killed with uploads pending, they may be lost")
+	case killed:
+		logger.Warn().Int(constants.LogPid, p.PID).Str(constants.LogName, p.Name).
+			Dur(constants.LogTimeout, timeout).
+			Msg("Process did not exit in time and was killed")
+	default:
+		logger.Info().Int(constants.LogPid, p.PID).Str(constants.LogName, p.Name).Msg("Process stopped")
+	}
+	return nil
+}
+
+// Stop sends SIGTERM so rclone can unmount and flush what it can, and kills the
+// process when it has not exited within timeout. It reports whether the
+// process had to be killed, and returns the error of ctx when it gave up
+// waiting before that.
+func (p *RcloneProcess) Stop(ctx context.Context, timeout time.Duration) (bool, error) {
+	if p.Command == nil || p.Command.Process == nil || p.done == nil {
+		return false, nil
+	}
+
+	if err := p.Command.Process.Signal(syscall.SIGTERM); err != nil {
+		if errors.Is(err, os.ErrProcessDone) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-timer.C:
+	}
+
+	if err := p.Command.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return true, err
+	}
+	select {
+	case <-p.done:
+	case <-time.After(reapTimeout):
+	}
+	return true, nil
+}
+
+// Terminate stops the process like Stop, without waiting for it: it sends
+// SIGTERM and kills the process in the background once timeout passed. Its
+// exit is published on events as always. A killed process that is not reaped
+// is reported as exited all the same, so its unit is not held up by a
+// process stuck in the kernel. Once events is done, stopping the process is
+// left to the shutdown.
+func (p *RcloneProcess) Terminate(timeout time.Duration, events *ExitEvents, logger zerolog.Logger) {
+	if p.Command == nil || p.Command.Process == nil || p.done == nil {
+		return
+	}
+	cmd, done, name, pid := p.Command, p.done, p.Name, p.PID
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		if !errors.Is(err, os.ErrProcessDone) {
+			logger.Warn().AnErr(constants.LogError, err).Int(constants.LogPid, pid).Str(constants.LogName, name).Msg("Failed to stop process")
+		}
+		return
+	}
+
+	events.run(func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-done:
+			return
+		case <-events.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		logger.Warn().Int(constants.LogPid, pid).Str(constants.LogName, name).
+			Dur(constants.LogTimeout, timeout).
+			Msg("Process did not exit in time and was killed")
+		if err := cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			logger.Warn().AnErr(constants.LogError, err).Int(constants.LogPid, pid).Str(constants.LogName, name).Msg("Failed to kill process")
+		}
+		select {
+		case <-done:
+		case <-events.ctx.Done():
+		case <-time.After(reapTimeout):
+			events.send(NewExitEvent(name, cmd, errNotReaped))
+		}
+	})
+}
+
+func (p *RcloneProcess) pendingUploads(ctx context.Context) (int64, bool) {
+	if p.Spec == nil || p.Exited {
+		return 0, false
+	}
+	addr, ok := p.Spec.RcAddr()
+	if !ok {
+		return 0, false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pendingUploadsTimeout)
+	defer cancel()
+	pending, err := PendingUploads(ctx, rcclient.NewClient(addr, rcclient.Options{Timeout: pendingUploadsTimeout}), "")
+	if err != nil {
+		return 0, false
+	}
+	return pending, true
+}
+
+// PendingUploads asks the VFS of fs how many files are still being uploaded or
+// waiting for upload. Without a VFS disk cache there is nothing to upload.
+func PendingUploads(ctx context.Context, client *rcclient.Client, fs string) (int64, error) {
+	stats, err := client.VfsStats(ctx, rcclient.VfsStatsRequest{Fs: fs})
+	if err != nil {
+		return 0, err
+	}
+	if stats.DiskCache == nil {
+		return 0, nil
+	}
+	return stats.DiskCache.UploadsInProgress + stats.DiskCache.UploadsQueued, nil
+}
@@ -0,0 +1,80 @@
+package mount_manager
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog"
+	"rclone-manager/internal/constants"
+	"rclone-manager/internal/unmount"
+	"time"
+)
+
+const busyPollInterval = time.Second
+
+// CheckBusy logs the processes holding files open under mountPoint before it
+// is unmounted, and applies the onBusy policy: wait for them to let go for up
+// to busyTimeout but no longer than ctx, unmount lazily anyway, or refuse
+// with an error wrapping unmount.ErrBusy. Processes it is not permitted to
+// inspect are only warned about.
+func CheckBusy(ctx context.Context, mountPoint, onBusy string, busyTimeout time.Duration, logger zerolog.Logger) error {
+	holders, unreadable, err := unmount.Holders(mountPoint)
+	if err != nil {
+		logger.Debug().AnErr(constants.LogError, err).Str(constants.LogMountPoint, mountPoint).
+			Msg("Failed to look for processes using the mount point")
+		return nil
+	}
+	if unreadable > 0 {
+		logger.Warn().Str(constants.LogMountPoint, mountPoint).
+			Int(constants.LogCount, unreadable).
+			Str(constants.LogOnBusy, onBusy).
+			Msg("Not permitted to inspect some processes, they may be using the mount point unnoticed")
+	}
+	if len(holders) == 0 {
+		return nil
+	}
+	logHolders(mountPoint, holders, onBusy, logger)
+
+	switch onBusy {
+	case constants.OnBusyRefuse:
+		return fmt.Errorf("%s: %w, %d processes are using it", mountPoint, unmount.ErrBusy, len(holders))
+	case constants.OnBusyWait:
+		waitUntil := time.Now().Add(busyTimeout)
+		if deadline, ok := ctx.Deadline(); ok && deadline.Before(waitUntil) {
+			waitUntil = deadline
+		}
+	wait:
+		for len(holders) > 0 && time.Now().Add(busyPollInterval).Before(waitUntil) {
+			select {
+			case <-ctx.Done():
+				break wait
+			case <-time.After(busyPollInterval):
+			}
+			if holders, _, err = unmount.Holders(mountPoint); err != nil {
+				break
+			}
+		}
+		if len(holders) > 0 {
+			logger.Warn().Str(constants.LogMountPoint, mountPoint).
+				Int(constants.LogCount, len(holders)).
+				Msg("Mount point is still in use, unmounting lazily")
+		} else {
+			logger.Info().Str(constants.LogMountPoint, mountPoint).
+				Msg("Mount point is no longer in use")
+		}
+	}
+	return nil
+}
+
+func logHolders(mountPoint string, holders []unmount.Holder, onBusy string, logger zerolog.Logger) {
+	for _, holder := range holders {
+		logger.Warn().Str(constants.LogMountPoint, mountPoint).
+			Int(constants.LogPid, holder.PID).
+			Str(constants.LogCommand, holder.Command).
+			Strs(constants.LogPaths, holder.Paths).
+			Msg("Process is using the mount point")
+	}
+	logger.Warn().Str(constants.LogMountPoint, mountPoint).
+		Int(constants.LogCount, len(holders)).
+		Str(constants.LogOnBusy, onBusy).
+		Msg("Mount point is busy")
+}
@@ -1,117 +1,224 @@
 package mount_manager
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/rs/zerolog"
+	"os/exec"
+	"rclone-manager/internal/circuit_breaker"
 	"rclone-manager/internal/config"
 	"rclone-manager/internal/constants"
 	"rclone-manager/internal/instance_tracker"
-	"sync"
+	"rclone-manager/internal/mountinfo"
+	"rclone-manager/internal/rclone_conf"
+	"rclone-manager/internal/status"
+	"rclone-manager/internal/supervisor"
+	"rclone-manager/internal/unmount"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// MountProcess is the supervisor unit of a mount, run as its own rclone mount
+// process.
 type MountProcess struct {
 	instance_tracker.RcloneProcess
-	MountPoint string
+	MountPoint  string
+	OnBusy      string
+	BusyTimeout time.Duration
+	Probe       config.MountProbeConfig
+
+	// mount is the config the mount point is prepared from
+	mount         config.Mount
+	mountPoints   *MountPoints
+	mountinfoPath string
+	probing       atomic.Bool
+	logger        zerolog.Logger
 }
 
-var tracker instance_tracker.InstanceTracker[MountProcess]
+func (p *MountProcess) Process() *instance_tracker.RcloneProcess {
+	return &p.RcloneProcess
+}
 
-func InitializeMountEndpoints(conf *config.Config, logger zerolog.Logger, processLock *sync.Mutex) {
-	processLock.Lock()
-	defer processLock.Unlock()
+func (p *MountProcess) Command() *exec.Cmd {
+	return supervisor.NewCommand(p.Spec)
+}
 
-	if len(conf.Mounts) == 0 {
-		logger.Debug().Msg("No rclone mounts endpoints defined... Skipping starting any")
-		return
+func (p *MountProcess) PreStart() error {
+	return p.mountPoints.Prepare(p.mount, p.logger)
+}
+
+// PreStop reports the processes using the mount point before rclone unmounts
+// it, and applies the onBusy policy of the mount.
+func (p *MountProcess) PreStop(ctx context.Context) error {
+	return CheckBusy(ctx, p.MountPoint, p.OnBusy, p.BusyTimeout, p.logger)
+}
+
+// PostStop cleans up after rclone when it could not unmount itself, e.g.
+// because it was killed.
+func (p *MountProcess) PostStop() {
+	_ = UnmountEndpoint(p, p.logger)
+}
+
+func (p *MountProcess) Refresh(desired supervisor.Unit) {
+	mount := desired.(*MountProcess)
+	p.Restart = mount.Restart
+	p.StopTimeout = mount.StopTimeout
+	p.OnBusy = mount.OnBusy
+	p.BusyTimeout = mount.BusyTimeout
+	p.Probe = mount.Probe
+	p.mount = mount.mount
+}
+
+// Checks restarts a mount that was lost right away, and one whose probe keeps
+// failing or timing out once FailureThreshold probes in a row did.
+func (p *MountProcess) Checks() supervisor.Checks {
+	check := mountCheck{
+		mountinfoPath: p.mountinfoPath,
+		mountPoint:    p.MountPoint,
+		timeout:       p.Probe.Timeout,
+		probing:       &p.probing,
 	}
-	Cleanup(conf, logger)
-	logger.Info().Msg("Initializing all mounts endpoints")
-	setupMountsFromConfig(conf, logger)
-
-	go MonitorMountProcesses(logger)
-}
-
-func StartMountWithRetries(instance *MountProcess, logger zerolog.Logger) *MountProcess {
-	retries := 0
-	for retries < 3 {
-		ensureExists(instance.MountPoint, logger)
-		cmd := createMountCommand(instance)
-		instance.Command = cmd
-		err := cmd.Start()
-		if err == nil {
-			logger.Info().
-				Str(constants.LogBackend, instance.BackendName).
-				Str(constants.LogMountPoint, instance.MountPoint).
-				Msg("Mount started successfully.")
-			instance.PID = cmd.Process.Pid
-			instance.StartedAt = time.Now()
-			instance.GracePeriod = 10 * time.Second
-			tracker.Track(instance.BackendName, instance)
-			go func() {
-				err := cmd.Wait()
-				if err != nil {
-					logger.Warn().AnErr(constants.LogError, err).
-						Str(constants.LogBackend, instance.BackendName).
-						Msg("Mount process exited with error.")
-				} else {
-					logger.Info().
-						Str(constants.LogBackend, instance.BackendName).
-						Msg("Mount process exited normally.")
-				}
-			}()
-			return instance
-		}
-		logger.Warn().AnErr(constants.LogError, err).Msgf("Mount failed. Retrying %d/3...", retries+1)
-		retries++
-		time.Sleep(5 * time.Second)
+	return supervisor.Checks{
+		Ready:            check.ready,
+		Period:           p.Probe.Period,
+		Timeout:          p.Probe.Timeout,
+		FailureThreshold: p.Probe.FailureThreshold,
+		StartupTimeout:   p.Probe.StartupTimeout,
+	}
+}
+
+// mountCheck checks a mount with what it captured from its unit.
+type mountCheck struct {
+	mountinfoPath string
+	mountPoint    string
+	timeout       time.Duration
+	probing       *atomic.Bool
+}
+
+// ready confirms rclone's FUSE filesystem is mounted at the mount point, as
+// the process can be alive while its mount never appeared or was unmounted.
+func (c mountCheck) ready(ctx context.Context) error {
+	if err := Mounted(c.mountinfoPath, c.mountPoint); err != nil {
+		return err
+	}
+	return c.probe(ctx)
+}
+
+// Mounted returns an error wrapping supervisor.ErrLost unless rclone's FUSE
+// filesystem is mounted at mountPoint according to the mountinfo at path.
+func Mounted(path, mountPoint string) error {
+	mounts, err := mountinfo.Load(path)
+	if err != nil {
+		return err
+	}
+	mount, ok := mountinfo.At(mounts, mountPoint)
+	if !ok {
+		return fmt.Errorf("%w: nothing is mounted at %s", supervisor.ErrLost, mountPoint)
+	}
+	if mount.FsType != constants.FsTypeRclone {
+		return fmt.Errorf("%w: %s is mounted at %s instead of %s", supervisor.ErrLost, mount.FsType, mountPoint, constants.FsTypeRclone)
 	}
-	logger.Error().Str(constants.LogBackend, instance.BackendName).Msg("Failed to start Mount after 3 attempts.")
 	return nil
 }
 
-func StopMount(instance *MountProcess, logger zerolog.Logger) {
-	logger.Info().Str(constants.LogBackend, instance.BackendName).Msg("Stopping mount process...")
-	UnmountEndpoint(instance, logger)
-	if err := instance.Command.Process.Kill(); err == nil {
-		tracker.Untrack(instance.BackendName)
-		logger.Info().Int(constants.LogPid, instance.PID).Str(constants.LogBackend, instance.BackendName).Msg("Mount process stopped")
-	} else {
-		logger.Warn().AnErr(constants.LogError, err).Int(constants.LogPid, instance.PID).Str(constants.LogBackend, instance.BackendName).Msg("Failed to stop mount process")
+// probe stats and lists the mount point in a goroutine of its own, as both
+// fail with ENOTCONN on a dead FUSE mount and block on a hung or just slow one.
+// Only ENOTCONN means the mount is lost, a probe that does not finish within
+// the probe timeout counts as a failed check. Only one probe runs at a time,
+// so one stuck in the kernel does not pile up more.
+func (c mountCheck) probe(ctx context.Context) error {
+	if !c.probing.CompareAndSwap(false, true) {
+		return fmt.Errorf("an earlier probe of %s is still blocked", c.mountPoint)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		defer c.probing.Store(false)
+		result <- statAndList(c.mountPoint)
+	}()
+
+	select {
+	case err := <-result:
+		if errors.Is(err, syscall.ENOTCONN) {
+			return fmt.Errorf("%w: %v", supervisor.ErrLost, err)
+		}
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("%s did not respond within %s", c.mountPoint, c.timeout)
 	}
 }
 
-func Cleanup(config *config.Config, logger zerolog.Logger) {
-	shouldMonitorProcesses = false
-	logger.Info().Msg("Cleaning up all rclone mount processes")
-	tracker.Range(func(key, value interface{}) bool {
-		instance := value.(*MountProcess)
-		StopMount(instance, logger)
-		return true
-	})
-	UnmountAllByPath(config, logger)
+func (p *MountProcess) MarshalZerologObject(e *zerolog.Event) {
+	e.Str(constants.LogMountPoint, p.MountPoint)
 }
 
-func ReconcileMounts(conf *config.Config, logger zerolog.Logger, processLock *sync.Mutex) {
-	processLock.Lock()
-	defer processLock.Unlock()
+// Manager runs every mount on a supervisor.
+type Manager struct {
+	*supervisor.Supervisor
+	mountPoints MountPoints
+	logger      zerolog.Logger
+}
 
-	logger.Info().Msg("Reconciling mounts...")
+func NewManager(events *instance_tracker.ExitEvents, breakers *circuit_breaker.Breakers, recorder *status.Recorder, logger zerolog.Logger) *Manager {
+	return &Manager{
+		Supervisor: supervisor.New(constants.Mount, events, breakers, recorder, logger),
+		logger:     logger,
+	}
+}
 
-	removeStaleMounts(conf, logger)
-	setupMountsFromConfig(conf, logger)
+func (m *Manager) Initialize(ctx context.Context, conf *config.Config, remotes *rclone_conf.RcloneConf) {
+	if len(conf.Mounts) == 0 {
+		m.logger.Debug().Msg("No rclone mounts endpoints defined... Skipping starting any")
+		return
+	}
+	cleanupCtx, cancel := context.WithTimeout(ctx, conf.ShutdownTimeout)
+	m.Cleanup(cleanupCtx, conf)
+	cancel()
+	m.logger.Info().Msg("Initializing all mounts endpoints")
+	m.Apply(ctx, m.units(conf, remotes))
 }
 
-func UnmountEndpoint(mount *MountProcess, logger zerolog.Logger) {
-	cmd := createFuseUnmountCommand(&MountProcess{MountPoint: mount.MountPoint})
-	err := cmd.Run()
-	if err != nil {
-		logger.Debug().AnErr(constants.LogError, err).
-			Str(constants.LogMountPoint, mount.MountPoint).
-			Msg("Failed to unmount path. It may not be mounted.")
-	} else {
+// Cleanup stops every mount in parallel, each within its stop timeout but no
+// later than the deadline of ctx, and unmounts whatever is left at the mount
+// points.
+func (m *Manager) Cleanup(ctx context.Context, config *config.Config) {
+	m.logger.Info().Msg("Cleaning up all rclone mount processes")
+	m.StopAll(ctx)
+	UnmountAllByPath(config, m.logger)
+}
+
+func (m *Manager) Reconcile(ctx context.Context, conf *config.Config, remotes *rclone_conf.RcloneConf) {
+	m.logger.Info().Msg("Reconciling mounts...")
+	m.Apply(ctx, m.units(conf, remotes))
+}
+
+// UnmountEndpoint lazily unmounts the mount point, where it not being mounted
+// is not a failure. Mounts other than rclone's are left alone, a unit refuses
+// to start over them.
+func UnmountEndpoint(mount *MountProcess, logger zerolog.Logger) error {
+	if mounted, ok := foreignMount(mount.MountPoint); ok {
+		logger.Debug().Str(constants.LogMountPoint, mount.MountPoint).
+			Str(constants.LogFsType, mounted.FsType).
+			Msg("Not unmounting path, it is not an rclone mount.")
+		return nil
+	}
+	err := unmount.Unmount(mount.MountPoint)
+	switch {
+	case err == nil:
 		logger.Info().Str(constants.LogMountPoint, mount.MountPoint).
 			Msg("Unmounted successfully.")
+	case errors.Is(err, unmount.ErrNotMounted):
+		logger.Debug().Str(constants.LogMountPoint, mount.MountPoint).
+			Msg("Nothing to unmount, path is not mounted.")
+		return nil
+	default:
+		logger.Warn().AnErr(constants.LogError, err).
+			Str(constants.LogMountPoint, mount.MountPoint).
+			Msg("Failed to unmount path.")
 	}
+	return err
 }
 
 func UnmountAllByPath(conf *config.Config, logger zerolog.Logger) {
@@ -119,6 +226,6 @@ func UnmountAllByPath(conf *config.Config, logger zerolog.Logger) {
 
 	for _, mount := range conf.Mounts {
 		logger.Info().Str(constants.MountPoint, mount.MountPoint).Msg("Unmounting...")
-		UnmountEndpoint(&MountProcess{MountPoint: mount.MountPoint}, logger)
+		_ = UnmountEndpoint(&MountProcess{MountPoint: mount.MountPoint}, logger)
 	}
 }
@@ -0,0 +1,216 @@
+package mount_manager
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"io"
+	"io/fs"
+	"os"
+	"rclone-manager/internal/config"
+	"rclone-manager/internal/constants"
+	"rclone-manager/internal/mountinfo"
+	"rclone-manager/internal/unmount"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+var (
+	// ErrForeignMount is returned when something other than rclone is already
+	// mounted at the mount point.
+	ErrForeignMount = errors.New("mount point is already mounted")
+	// ErrNotEmpty is returned when the mount point has files in it that the
+	// mount would hide and the mount does not allow that.
+	ErrNotEmpty = errors.New("mount point is not empty")
+)
+
+// MountPoints prepares the mount points of a manager. Its zero value is ready
+// to use.
+type MountPoints struct {
+	// ownershipWarned holds the mount points whose mode or owner could not be
+	// set for lack of permission, which is only warned about once.
+	ownershipWarned sync.Map
+}
+
+// Prepare makes the mount point of mount safe to mount at. It unmounts an
+// rclone mount left behind there and refuses any other mount, or a mount
+// point that is not shared when the propagation check fails it. It creates
+// the directory or restores its mode, owner and group when they drifted, and
+// refuses a non-empty directory unless the mount allows it.
+func (p *MountPoints) Prepare(mount config.Mount, logger zerolog.Logger) error {
+	if err := checkMounted(mount.MountPoint, logger); err != nil {
+		return err
+	}
+	if err := checkShared(mount); err != nil {
+		return err
+	}
+	if err := p.ensureDirectory(mount, logger); err != nil {
+		return err
+	}
+	return checkEmpty(mount, logger)
+}
+
+func checkMounted(mountPoint string, logger zerolog.Logger) error {
+	mounts, err := mountinfo.Load(mountinfo.Path())
+	if err != nil {
+		logger.Debug().AnErr(constants.LogError, err).Str(constants.LogMountPoint, mountPoint).
+			Msg("Failed to read mountinfo, not checking what is mounted at the mount point")
+		return nil
+	}
+	mounted, ok := mountinfo.At(mounts, mountPoint)
+	if !ok {
+		return nil
+	}
+	if mounted.FsType != constants.FsTypeRclone {
+		return fmt.Errorf("%w: %s is mounted at %s from %s", ErrForeignMount, mounted.FsType, mountPoint, mounted.Source)
+	}
+
+	logger.Warn().Str(constants.LogMountPoint, mountPoint).Str(constants.LogSource, mounted.Source).
+		Msg("An rclone mount was left at the mount point, unmounting it first")
+	if err := unmount.Unmount(mountPoint); err != nil && !errors.Is(err, unmount.ErrNotMounted) {
+		return err
+	}
+	return nil
+}
+
+// foreignMount returns what is mounted at mountPoint when that is not rclone,
+// which the manager must leave alone.
+func foreignMount(mountPoint string) (mountinfo.Mount, bool) {
+	mounts, err := mountinfo.Load(mountinfo.Path())
+	if err != nil {
+		return mountinfo.Mount{}, false
+	}
+	mounted, ok := mountinfo.At(mounts, mountPoint)
+	if !ok || mounted.FsType == constants.FsTypeRclone {
+		return mountinfo.Mount{}, false
+	}
+	return mounted, true
+}
+
+func (p *MountPoints) ensureDirectory(mount config.Mount, logger zerolog.Logger) error {
+	mountPoint := mount.MountPoint
+	info, err := os.Stat(mountPoint)
+	switch {
+	case os.IsNotExist(err):
+		logger.Info().Str(constants.LogMountPoint, mountPoint).Msg("Creating mount point...")
+		if err := os.MkdirAll(mountPoint, 0777); err != nil {
+			logger.Error().Err(err).Str(constants.LogMountPoint, mountPoint).
+				Msg("Failed to create mount point")
+			return err
+		}
+		if err := p.permitted(mountPoint, applyOwnership(mount, nil, logger), logger); err != nil {
+			return err
+		}
+		logger.Info().Str(constants.LogMountPoint, mountPoint).
+			Msg("Mount point created successfully.")
+		return nil
+	case err != nil:
+		return err
+	case !info.IsDir():
+		return fmt.Errorf("mount point %s is not a directory", mountPoint)
+	}
+	return p.permitted(mountPoint, applyOwnership(mount, info, logger), logger)
+}
+
+// permitted lets a mount start when it is not permitted to set the mode or
+// owner of its mount point, e.g. when not run as root, and warns about it once.
+func (p *MountPoints) permitted(mountPoint string, err error, logger zerolog.Logger) error {
+	if !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	if _, warned := p.ownershipWarned.LoadOrStore(mountPoint, true); !warned {
+		logger.Warn().AnErr(constants.LogError, err).Str(constants.LogMountPoint, mountPoint).
+			Msg("Not permitted to set the mode or owner of the mount point, leaving it as it is")
+	}
+	return nil
+}
+
+// applyOwnership sets the configured mode, owner and group of the mount point
+// that differ from info, or all of them when info is nil as it was just created.
+func applyOwnership(mount config.Mount, info os.FileInfo, logger zerolog.Logger) error {
+	mountPoint := mount.MountPoint
+	if mount.DirMode != "" {
+		mode, err := config.ParseMode(mount.DirMode)
+		if err != nil {
+			return err
+		}
+		if info == nil || info.Mode().Perm() != mode {
+			if info != nil {
+				logger.Warn().Str(constants.LogMountPoint, mountPoint).
+					Str(constants.LogDirMode, fmt.Sprintf("%#o", info.Mode().Perm())).
+					Msg("Mount point mode differs from the config, restoring it")
+			}
+			if err := os.Chmod(mountPoint, mode); err != nil {
+				return err
+			}
+		}
+	}
+
+	uid, gid := -1, -1
+	if mount.Owner != "" {
+		owner, err := config.LookupOwner(mount.Owner)
+		if err != nil {
+			return err
+		}
+		uid = owner
+	}
+	if mount.Group != "" {
+		group, err := config.LookupGroup(mount.Group)
+		if err != nil {
+			return err
+		}
+		gid = group
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	if info != nil {
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || (uid == -1 || int(stat.Uid) == uid) && (gid == -1 || int(stat.Gid) == gid) {
+			return nil
+		}
+		logger.Warn().Str(constants.LogMountPoint, mountPoint).
+			Uint32(constants.LogOwner, stat.Uid).
+			Uint32(constants.LogGroup, stat.Gid).
+			Msg("Mount point owner differs from the config, restoring it")
+	}
+	return os.Chown(mountPoint, uid, gid)
+}
+
+func checkEmpty(mount config.Mount, logger zerolog.Logger) error {
+	dir, err := os.Open(mount.MountPoint)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(1)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	if !allowsNonEmpty(mount) {
+		return fmt.Errorf("%w: %s has files in it that the mount would hide, set allowNonEmpty to mount anyway", ErrNotEmpty, mount.MountPoint)
+	}
+	logger.Info().Str(constants.LogMountPoint, mount.MountPoint).
+		Msg("Mounting over a non-empty mount point, its files are hidden while mounted")
+	return nil
+}
+
+// allowsNonEmpty reports whether the mount may hide the files in its mount
+// point, through allowNonEmpty or RCLONE_ALLOW_NON_EMPTY in the environment of
+// the unit or of rclone-manager itself, which rclone inherits.
+func allowsNonEmpty(mount config.Mount) bool {
+	if mount.AllowNonEmpty {
+		return true
+	}
+	value, ok := mount.Environment[constants.AllowNonEmptyEnvVar]
+	if !ok {
+		value, ok = os.LookupEnv(constants.AllowNonEmptyEnvVar)
+	}
+	allowed, err := strconv.ParseBool(value)
+	return ok && err == nil && allowed
+}
@@ -0,0 +1,99 @@
+package mount_manager
+
+import (
+	"errors"
+	"github.com/rs/zerolog"
+	"path/filepath"
+	"rclone-manager/internal/config"
+	"rclone-manager/internal/constants"
+	"rclone-manager/internal/mountinfo"
+	"rclone-manager/internal/unmount"
+	"sort"
+	"strings"
+)
+
+// FindOrphans returns the rclone mounts under roots that are not a mount point
+// of conf, deepest first so nested mounts can be unmounted in order.
+func FindOrphans(mounts []mountinfo.Mount, roots []string, conf *config.Config) []mountinfo.Mount {
+	configured := make(map[string]bool, len(conf.Mounts))
+	for _, mount := range conf.Mounts {
+		configured[filepath.Clean(mount.MountPoint)] = true
+	}
+
+	var orphans []mountinfo.Mount
+	seen := make(map[string]bool)
+	for _, mount := range mounts {
+		if mount.FsType != constants.FsTypeRclone || configured[mount.MountPoint] || seen[mount.MountPoint] {
+			continue
+		}
+		if !underAny(mount.MountPoint, roots) {
+			continue
+		}
+		seen[mount.MountPoint] = true
+		orphans = append(orphans, mount)
+	}
+
+	sort.SliceStable(orphans, func(i, j int) bool {
+		return len(orphans[i].MountPoint) > len(orphans[j].MountPoint)
+	})
+	return orphans
+}
+
+func underAny(path string, roots []string) bool {
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		if path == root || strings.HasPrefix(path, strings.TrimSuffix(root, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanupOrphans lazily unmounts every orphaned rclone mount under the roots
+// configured in orphanMounts, or only lists them on a dry run.
+func CleanupOrphans(conf *config.Config, logger zerolog.Logger) {
+	roots := conf.OrphanMounts.Roots
+	if len(roots) == 0 {
+		return
+	}
+
+	mounts, err := mountinfo.Load(mountinfo.Path())
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to read mountinfo, skipping the orphaned mount cleanup")
+		return
+	}
+
+	orphans := FindOrphans(mounts, roots, conf)
+	if len(orphans) == 0 {
+		logger.Info().Strs(constants.LogRoots, roots).Msg("No orphaned rclone mounts found")
+		return
+	}
+
+	cleaned := make([]string, 0, len(orphans))
+	for _, orphan := range orphans {
+		if conf.OrphanMounts.DryRun {
+			logger.Warn().Str(constants.LogMountPoint, orphan.MountPoint).
+				Str(constants.LogSource, orphan.Source).
+				Msg("Orphaned rclone mount would be unmounted (dry run)")
+			continue
+		}
+		logger.Warn().Str(constants.LogMountPoint, orphan.MountPoint).
+			Str(constants.LogSource, orphan.Source).
+			Msg("Unmounting orphaned rclone mount")
+		if err := unmount.Unmount(orphan.MountPoint); err != nil && !errors.Is(err, unmount.ErrNotMounted) {
+			logger.Error().Err(err).Str(constants.LogMountPoint, orphan.MountPoint).
+				Msg("Failed to unmount orphaned rclone mount")
+			continue
+		}
+		cleaned = append(cleaned, orphan.MountPoint)
+	}
+
+	if conf.OrphanMounts.DryRun {
+		logger.Warn().Int(constants.LogCount, len(orphans)).
+			Msg("Dry run, orphaned rclone mounts were left in place")
+		return
+	}
+	logger.Info().Int(constants.LogCount, len(cleaned)).
+		Strs(constants.LogMountPoints, cleaned).
+		Msg("Orphaned rclone mounts cleaned up")
+}
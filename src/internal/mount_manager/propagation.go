@@ -0,0 +1,92 @@
+package mount_manager
+
+import (
+	"fmt"
+	"github.com/rs/zerolog"
+	"path/filepath"
+	"rclone-manager/internal/config"
+	"rclone-manager/internal/constants"
+	"rclone-manager/internal/mountinfo"
+	"rclone-manager/internal/status"
+	"time"
+)
+
+// filesystemOf returns the filesystem rclone mounts at mountPoint are made
+// on, whose propagation decides whether the host and other containers see
+// them. rclone's own mount at the mount point is skipped.
+func filesystemOf(mounts []mountinfo.Mount, mountPoint string) (mountinfo.Mount, bool) {
+	mountPoint = filepath.Clean(mountPoint)
+	candidates := make([]mountinfo.Mount, 0, len(mounts))
+	for _, mount := range mounts {
+		if mount.MountPoint == mountPoint && mount.FsType == constants.FsTypeRclone {
+			continue
+		}
+		candidates = append(candidates, mount)
+	}
+	return mountinfo.Containing(candidates, mountPoint)
+}
+
+// CheckPropagation warns about every mount whose mount point is not on a
+// filesystem with shared propagation, e.g. when the :shared bind mount was
+// dropped from compose.yaml. Its mounts work inside the container but are
+// invisible everywhere else. The result is recorded in the status.
+func CheckPropagation(conf *config.Config, recorder *status.Recorder, logger zerolog.Logger) {
+	propagation := make(map[string]status.Propagation)
+	defer func() { recorder.SetPropagation(propagation) }()
+	if len(conf.Mounts) == 0 {
+		return
+	}
+
+	mounts, err := mountinfo.Load(mountinfo.Path())
+	if err != nil {
+		logger.Warn().AnErr(constants.LogError, err).Msg("Failed to read mountinfo, not checking mount propagation")
+		return
+	}
+	for _, mount := range conf.Mounts {
+		if mount.PropagationCheck == constants.PropagationCheckOff {
+			continue
+		}
+		filesystem, ok := filesystemOf(mounts, mount.MountPoint)
+		if !ok {
+			continue
+		}
+		propagation[mount.MountPoint] = status.Propagation{
+			Type:       filesystem.Propagation(),
+			Filesystem: filesystem.MountPoint,
+			CheckedAt:  time.Now(),
+		}
+		if filesystem.Propagation() == constants.PropagationShared {
+			continue
+		}
+
+		event := logger.Warn()
+		if mount.PropagationCheck == constants.PropagationCheckFail {
+			event = logger.Error()
+		}
+		event.Str(constants.LogMountPoint, mount.MountPoint).
+			Str(constants.LogFilesystem, filesystem.MountPoint).
+			Str(constants.LogPropagation, filesystem.Propagation()).
+			Str(constants.LogPolicy, mount.PropagationCheck).
+			Msg("Mount point is not on a shared mount, the mount will not be visible outside the container")
+	}
+}
+
+// checkShared refuses a mount whose propagation check fails it when its mount
+// point is not on a shared filesystem.
+func checkShared(mount config.Mount) error {
+	if mount.PropagationCheck != constants.PropagationCheckFail {
+		return nil
+	}
+	mounts, err := mountinfo.Load(mountinfo.Path())
+	if err != nil {
+		return err
+	}
+	filesystem, ok := filesystemOf(mounts, mount.MountPoint)
+	if !ok {
+		return nil
+	}
+	if propagation := filesystem.Propagation(); propagation != constants.PropagationShared {
+		return fmt.Errorf("mount point %s is on %s with %s propagation instead of %s", mount.MountPoint, filesystem.MountPoint, propagation, constants.PropagationShared)
+	}
+	return nil
+}
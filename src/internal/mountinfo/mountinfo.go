@@ -0,0 +1,170 @@
+package mountinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"rclone-manager/internal/constants"
+	"rclone-manager/internal/environment"
+	"strconv"
+	"strings"
+)
+
+// Mount is a line of mountinfo, see proc_pid_mountinfo(5).
+type Mount struct {
+	ID           int
+	ParentID     int
+	Device       string
+	Root         string
+	MountPoint   string
+	Options      string
+	Optional     []string
+	FsType       string
+	Source       string
+	SuperOptions string
+}
+
+// Path is the mountinfo of the manager's own mount namespace, unless
+// RCLONE_MANAGER_MOUNTINFO points elsewhere.
+func Path() string {
+	return environment.GetEnvWithFallback(constants.MountinfoEnvVar, constants.DefaultMountinfo)
+}
+
+func Load(path string) ([]Mount, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Parse(file)
+}
+
+func Parse(r io.Reader) ([]Mount, error) {
+	var mounts []Mount
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		mount, err := parseLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("mountinfo line %d: %w", line, err)
+		}
+		mounts = append(mounts, mount)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+func parseLine(line string) (Mount, error) {
+	fields := strings.Fields(line)
+	separator := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			separator = i
+			break
+		}
+	}
+	if separator < 0 || len(fields) < separator+3 {
+		return Mount{}, fmt.Errorf("malformed line %q", line)
+	}
+
+	id, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return Mount{}, fmt.Errorf("invalid mount id %q", fields[0])
+	}
+	parentID, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return Mount{}, fmt.Errorf("invalid parent id %q", fields[1])
+	}
+
+	mount := Mount{
+		ID:         id,
+		ParentID:   parentID,
+		Device:     fields[2],
+		Root:       unescape(fields[3]),
+		MountPoint: unescape(fields[4]),
+		Options:    fields[5],
+		Optional:   fields[6:separator],
+		FsType:     fields[separator+1],
+		Source:     unescape(fields[separator+2]),
+	}
+	if len(fields) > separator+3 {
+		mount.SuperOptions = fields[separator+3]
+	}
+	return mount, nil
+}
+
+// unescape decodes the octal escapes the kernel uses for space, tab, newline
+// and backslash in paths.
+func unescape(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if value, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+// At returns the mount on top at path, the one that is visible there when
+// several are stacked.
+func At(mounts []Mount, path string) (Mount, bool) {
+	path = filepath.Clean(path)
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].MountPoint == path {
+			return mounts[i], true
+		}
+	}
+	return Mount{}, false
+}
+
+// Containing returns the mount path is on, the top-most one mounted at path
+// or else at its closest ancestor.
+func Containing(mounts []Mount, path string) (Mount, bool) {
+	path = filepath.Clean(path)
+	best := -1
+	for i, mount := range mounts {
+		if mount.MountPoint != path && mount.MountPoint != "/" && !strings.HasPrefix(path, mount.MountPoint+"/") {
+			continue
+		}
+		if best == -1 || len(mount.MountPoint) >= len(mounts[best].MountPoint) {
+			best = i
+		}
+	}
+	if best == -1 {
+		return Mount{}, false
+	}
+	return mounts[best], true
+}
+
+// Propagation is the propagation type of the mount from its optional fields,
+// shared when it is in a peer group even if it also receives from a master.
+func (m Mount) Propagation() string {
+	propagation := constants.PropagationPrivate
+	for _, field := range m.Optional {
+		tag, _, _ := strings.Cut(field, ":")
+		switch tag {
+		case "shared":
+			return constants.PropagationShared
+		case "master":
+			propagation = constants.PropagationSlave
+		case "unbindable":
+			propagation = constants.PropagationUnbindable
+		}
+	}
+	return propagation
+}
@@ -0,0 +1,110 @@
+package mountinfo
+
+import (
+	"os"
+	"path/filepath"
+	"rclone-manager/internal/constants"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const sample = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+40 22 0:35 / /mnt/rclone rw,relatime shared:20 - ext4 /dev/sdb1 rw
+41 40 0:36 / /mnt/rclone/my\040drive rw,nosuid,nodev - fuse.rclone My\040Drive: rw,user_id=0,group_id=0
+42 40 0:37 / /mnt/rclone/tabs\011and\134slash rw master:3 - fuse.rclone Other: rw
+43 41 0:38 / /mnt/rclone/my\040drive rw - fuse.rclone Stacked: rw
+`
+
+// writeMountinfo points RCLONE_MANAGER_MOUNTINFO at a file holding content.
+func writeMountinfo(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "mountinfo")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(constants.MountinfoEnvVar, path)
+	return path
+}
+
+func TestPathHonoursEnv(t *testing.T) {
+	path := writeMountinfo(t, sample)
+	if got := Path(); got != path {
+		t.Fatalf("Path() = %q, want %q", got, path)
+	}
+
+	t.Setenv(constants.MountinfoEnvVar, "")
+	if got := Path(); got != constants.DefaultMountinfo {
+		t.Fatalf("Path() = %q without the env var, want %q", got, constants.DefaultMountinfo)
+	}
+}
+
+func TestLoadParsesEscapedPaths(t *testing.T) {
+	writeMountinfo(t, sample)
+	mounts, err := Load(Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 5 {
+		t.Fatalf("got %d mounts, want 5", len(mounts))
+	}
+
+	drive := mounts[2]
+	if drive.MountPoint != "/mnt/rclone/my drive" || drive.Source != "My Drive:" || drive.FsType != "fuse.rclone" {
+		t.Errorf("mount = %+v, want My Drive: on /mnt/rclone/my drive", drive)
+	}
+	if drive.ID != 41 || drive.ParentID != 40 || len(drive.Optional) != 0 {
+		t.Errorf("ids = %d/%d, optional %v, want 41/40 and none", drive.ID, drive.ParentID, drive.Optional)
+	}
+	if got := mounts[3].MountPoint; got != "/mnt/rclone/tabs\tand\\slash" {
+		t.Errorf("mount point = %q, want a tab and a backslash decoded", got)
+	}
+	if got := mounts[0].Optional; !slices.Equal(got, []string{"shared:1"}) {
+		t.Errorf("optional fields = %v, want [shared:1]", got)
+	}
+}
+
+func TestParseRejectsMalformedLine(t *testing.T) {
+	_, err := Parse(strings.NewReader(sample + "44 40 0:39 / /mnt/x rw shared:2\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 6") {
+		t.Fatalf("err = %v, want the malformed line 6 reported", err)
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	for field, want := range map[string]string{
+		`plain`:        "plain",
+		`a\040b`:       "a b",
+		`a\011b\012c`:  "a\tb\nc",
+		`back\134`:     `back\`,
+		`not\08escape`: `not\08escape`,
+		`trailing\04`:  `trailing\04`,
+	} {
+		if got := unescape(field); got != want {
+			t.Errorf("unescape(%q) = %q, want %q", field, got, want)
+		}
+	}
+}
+
+func TestAtReturnsTopMount(t *testing.T) {
+	writeMountinfo(t, sample)
+	mounts, err := Load(Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mount, ok := At(mounts, "/mnt/rclone/my drive/")
+	if !ok || mount.Source != "Stacked:" {
+		t.Errorf("At = %+v, %v, want the stacked mount on top", mount, ok)
+	}
+	if _, ok := At(mounts, "/mnt/rclone/missing"); ok {
+		t.Error("At found a mount at a path nothing is mounted at")
+	}
+
+	mount, ok = Containing(mounts, "/mnt/rclone/other/file")
+	if !ok || mount.MountPoint != "/mnt/rclone" {
+		t.Errorf("Containing = %+v, %v, want /mnt/rclone", mount, ok)
+	}
+	if got := mounts[3].Propagation(); got != constants.PropagationSlave {
+		t.Errorf("Propagation() = %q, want %q", got, constants.PropagationSlave)
+	}
+}
@@ -0,0 +1,97 @@
+package planner
+
+import (
+	"rclone-manager/internal/config"
+	"rclone-manager/internal/rclone_conf"
+	"rclone-manager/internal/spec"
+	"sort"
+)
+
+type Action string
+
+const (
+	ActionStart     Action = "start"
+	ActionStop      Action = "stop"
+	ActionRestart   Action = "restart"
+	ActionUnchanged Action = "unchanged"
+)
+
+const (
+	KindMount = "mount"
+	KindServe = "serve"
+)
+
+type Step struct {
+	Kind    string
+	Name    string
+	Action  Action
+	Reasons []string
+	// Spec is what the unit will run with, or what it ran with when stopping
+	Spec *spec.Spec
+}
+
+type unit struct {
+	kind string
+	name string
+	spec *spec.Spec
+}
+
+// Plan works out what applying candidate on top of current would do to each
+// unit, with the rclone.conf each of them runs with. current may be nil, in
+// which case every unit is started.
+func Plan(current, candidate *config.Config, currentRemotes, remotes *rclone_conf.RcloneConf) []Step {
+	currentUnits := make(map[string]unit)
+	if current != nil {
+		for _, u := range units(current, currentRemotes) {
+			currentUnits[u.kind+"/"+u.name] = u
+		}
+	}
+
+	var steps []Step
+	desired := make(map[string]bool)
+	for _, u := range units(candidate, remotes) {
+		key := u.kind + "/" + u.name
+		desired[key] = true
+
+		existing, ok := currentUnits[key]
+		switch {
+		case !ok:
+			steps = append(steps, Step{Kind: u.kind, Name: u.name, Action: ActionStart, Reasons: []string{"new in config"}, Spec: u.spec})
+		case existing.spec.Fingerprint() != u.spec.Fingerprint():
+			var reasons []string
+			if current.Mode != candidate.Mode {
+				reasons = append(reasons, "mode: "+current.Mode+" -> "+candidate.Mode)
+			}
+			reasons = append(reasons, spec.Diff(existing.spec, u.spec)...)
+			steps = append(steps, Step{Kind: u.kind, Name: u.name, Action: ActionRestart, Reasons: reasons, Spec: u.spec})
+		default:
+			steps = append(steps, Step{Kind: u.kind, Name: u.name, Action: ActionUnchanged, Spec: u.spec})
+		}
+	}
+
+	var stale []Step
+	for key, u := range currentUnits {
+		if !desired[key] {
+			stale = append(stale, Step{Kind: u.kind, Name: u.name, Action: ActionStop, Reasons: []string{"removed from config"}, Spec: u.spec})
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		if stale[i].Kind != stale[j].Kind {
+			return stale[i].Kind < stale[j].Kind
+		}
+		return stale[i].Name < stale[j].Name
+	})
+
+	return append(steps, stale...)
+}
+
+func units(conf *config.Config, remotes *rclone_conf.RcloneConf) []unit {
+	var result []unit
+	for _, mount := range conf.Mounts {
+		result = append(result, unit{kind: KindMount, name: mount.Name, spec: spec.ForMount(conf.Mode, mount, remotes)})
+	}
+	for _, serve := range conf.Serves {
+		result = append(result, unit{kind: KindServe, name: serve.Name, spec: spec.ForServe(conf.Mode, serve, remotes)})
+	}
+	return result
+}
@@ -0,0 +1,128 @@
+package rcclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DefaultTimeout = 30 * time.Second
+
+type Options struct {
+	User    string
+	Pass    string
+	Timeout time.Duration
+}
+
+type Client struct {
+	baseURL    string
+	user       string
+	pass       string
+	httpClient *http.Client
+}
+
+// NewClient accepts a TCP address (host:port, :port or a full http(s) URL) or a
+// unix socket given as unix:///path/to/socket or an absolute path.
+func NewClient(addr string, opts Options) *Client {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	httpClient := &http.Client{Timeout: timeout}
+	baseURL := baseURLFromAddr(addr)
+
+	if socketPath, ok := unixSocketPath(addr); ok {
+		httpClient.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		}
+		baseURL = "http://unix"
+	}
+
+	return &Client{
+		baseURL:    baseURL,
+		user:       opts.User,
+		pass:       opts.Pass,
+		httpClient: httpClient,
+	}
+}
+
+func (c *Client) Call(ctx context.Context, method string, in interface{}, out interface{}) error {
+	if in == nil {
+		in = struct{}{}
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("encoding %s request: %w", method, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.user != "" || c.pass != "" {
+		req.SetBasicAuth(c.user, c.pass)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("calling %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading %s response: %w", method, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return decodeError(method, resp.StatusCode, respBody)
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("decoding %s response: %w", method, err)
+	}
+	return nil
+}
+
+func (c *Client) Noop(ctx context.Context) error {
+	return c.Call(ctx, "rc/noop", nil, nil)
+}
+
+func unixSocketPath(addr string) (string, bool) {
+	if strings.HasPrefix(addr, "unix://") {
+		return strings.TrimPrefix(addr, "unix://"), true
+	}
+	if strings.HasPrefix(addr, "/") {
+		return addr, true
+	}
+	return "", false
+}
+
+func baseURLFromAddr(addr string) string {
+	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		return strings.TrimSuffix(addr, "/")
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://" + addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
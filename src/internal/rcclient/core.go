@@ -0,0 +1,80 @@
+package rcclient
+
+import "context"
+
+type StatsRequest struct {
+	Group string `json:"group,omitempty"`
+	Short bool   `json:"short,omitempty"`
+}
+
+type Transfer struct {
+	Name       string  `json:"name"`
+	Size       int64   `json:"size"`
+	Bytes      int64   `json:"bytes"`
+	Percentage int     `json:"percentage"`
+	Speed      float64 `json:"speed"`
+	SpeedAvg   float64 `json:"speedAvg"`
+	Eta        *int64  `json:"eta"`
+	Group      string  `json:"group"`
+}
+
+type Stats struct {
+	Bytes            int64      `json:"bytes"`
+	Checks           int64      `json:"checks"`
+	DeletedDirs      int64      `json:"deletedDirs"`
+	Deletes          int64      `json:"deletes"`
+	ElapsedTime      float64    `json:"elapsedTime"`
+	Errors           int64      `json:"errors"`
+	Eta              *int64     `json:"eta"`
+	FatalError       bool       `json:"fatalError"`
+	LastError        string     `json:"lastError"`
+	Renames          int64      `json:"renames"`
+	RetryError       bool       `json:"retryError"`
+	ServerSideCopies int64      `json:"serverSideCopies"`
+	ServerSideMoves  int64      `json:"serverSideMoves"`
+	Speed            float64    `json:"speed"`
+	TotalBytes       int64      `json:"totalBytes"`
+	TotalChecks      int64      `json:"totalChecks"`
+	TotalTransfers   int64      `json:"totalTransfers"`
+	TransferTime     float64    `json:"transferTime"`
+	Transfers        int64      `json:"transfers"`
+	Transferring     []Transfer `json:"transferring"`
+	Checking         []string   `json:"checking"`
+}
+
+type BwLimitRequest struct {
+	Rate string `json:"rate,omitempty"`
+}
+
+type BwLimit struct {
+	BytesPerSecond   int64  `json:"bytesPerSecond"`
+	BytesPerSecondTx int64  `json:"bytesPerSecondTx"`
+	BytesPerSecondRx int64  `json:"bytesPerSecondRx"`
+	Rate             string `json:"rate"`
+}
+
+func (c *Client) CoreStats(ctx context.Context, req StatsRequest) (*Stats, error) {
+	var resp Stats
+	if err := c.Call(ctx, "core/stats", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetBwLimit returns the current limit, SetBwLimit changes it using rclone's
+// rate syntax, e.g. "10M", "off" or a timetable.
+func (c *Client) GetBwLimit(ctx context.Context) (*BwLimit, error) {
+	return c.bwLimit(ctx, BwLimitRequest{})
+}
+
+func (c *Client) SetBwLimit(ctx context.Context, rate string) (*BwLimit, error) {
+	return c.bwLimit(ctx, BwLimitRequest{Rate: rate})
+}
+
+func (c *Client) bwLimit(ctx context.Context, req BwLimitRequest) (*BwLimit, error) {
+	var resp BwLimit
+	if err := c.Call(ctx, "core/bwlimit", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
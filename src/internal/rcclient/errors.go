@@ -0,0 +1,46 @@
+package rcclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error is the decoded body rclone returns when an RC call fails.
+type Error struct {
+	Method  string                 `json:"-"`
+	Status  int                    `json:"status"`
+	Message string                 `json:"error"`
+	Path    string                 `json:"path"`
+	Input   map[string]interface{} `json:"input"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s failed with status %d: %s", e.Method, e.Status, e.Message)
+}
+
+func IsNotFound(err error) bool {
+	var rcErr *Error
+	return errors.As(err, &rcErr) && rcErr.Status == http.StatusNotFound
+}
+
+func IsUnauthorized(err error) bool {
+	var rcErr *Error
+	return errors.As(err, &rcErr) && (rcErr.Status == http.StatusUnauthorized || rcErr.Status == http.StatusForbidden)
+}
+
+func decodeError(method string, status int, body []byte) error {
+	rcErr := &Error{Method: method}
+	if err := json.Unmarshal(body, rcErr); err != nil || rcErr.Message == "" {
+		rcErr.Message = strings.TrimSpace(string(body))
+	}
+	if rcErr.Status == 0 {
+		rcErr.Status = status
+	}
+	if rcErr.Message == "" {
+		rcErr.Message = http.StatusText(status)
+	}
+	return rcErr
+}
@@ -0,0 +1,45 @@
+package rcclient
+
+import "context"
+
+type MountRequest struct {
+	Fs         string                 `json:"fs"`
+	MountPoint string                 `json:"mountPoint"`
+	MountType  string                 `json:"mountType,omitempty"`
+	VfsOpt     map[string]interface{} `json:"vfsOpt,omitempty"`
+	MountOpt   map[string]interface{} `json:"mountOpt,omitempty"`
+}
+
+type UnmountRequest struct {
+	MountPoint string `json:"mountPoint"`
+}
+
+type MountPoint struct {
+	Fs         string `json:"Fs"`
+	MountPoint string `json:"MountPoint"`
+	MountedOn  string `json:"MountedOn"`
+}
+
+type ListMountsResponse struct {
+	MountPoints []MountPoint `json:"mountPoints"`
+}
+
+func (c *Client) Mount(ctx context.Context, req MountRequest) error {
+	return c.Call(ctx, "mount/mount", req, nil)
+}
+
+func (c *Client) Unmount(ctx context.Context, mountPoint string) error {
+	return c.Call(ctx, "mount/unmount", UnmountRequest{MountPoint: mountPoint}, nil)
+}
+
+func (c *Client) UnmountAll(ctx context.Context) error {
+	return c.Call(ctx, "mount/unmountall", nil, nil)
+}
+
+func (c *Client) ListMounts(ctx context.Context) ([]MountPoint, error) {
+	var resp ListMountsResponse
+	if err := c.Call(ctx, "mount/listmounts", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.MountPoints, nil
+}
@@ -0,0 +1,24 @@
+package rcclient
+
+import "context"
+
+type AboutRequest struct {
+	Fs string `json:"fs"`
+}
+
+type About struct {
+	Total   *int64 `json:"total,omitempty"`
+	Used    *int64 `json:"used,omitempty"`
+	Trashed *int64 `json:"trashed,omitempty"`
+	Other   *int64 `json:"other,omitempty"`
+	Free    *int64 `json:"free,omitempty"`
+	Objects *int64 `json:"objects,omitempty"`
+}
+
+func (c *Client) OperationsAbout(ctx context.Context, fs string) (*About, error) {
+	var resp About
+	if err := c.Call(ctx, "operations/about", AboutRequest{Fs: fs}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -0,0 +1,11 @@
+package rcclient
+
+import "context"
+
+// OptionBlocks maps an option block name (main, vfs, mount, ...) to the
+// options to change within it, e.g. {"main": {"LogLevel": "DEBUG"}}.
+type OptionBlocks map[string]map[string]interface{}
+
+func (c *Client) OptionsSet(ctx context.Context, blocks OptionBlocks) error {
+	return c.Call(ctx, "options/set", blocks, nil)
+}
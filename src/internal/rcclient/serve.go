@@ -0,0 +1,53 @@
+package rcclient
+
+import "context"
+
+type ServeStartRequest struct {
+	Type string `json:"type"`
+	Fs   string `json:"fs"`
+	Addr string `json:"addr"`
+}
+
+type ServeStartResponse struct {
+	Id   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+type ServeStopRequest struct {
+	Id string `json:"id"`
+}
+
+type ServeParams struct {
+	Type string `json:"type"`
+	Fs   string `json:"fs"`
+}
+
+type Serve struct {
+	Id     string      `json:"id"`
+	Addr   string      `json:"addr"`
+	Params ServeParams `json:"params"`
+}
+
+type ServeListResponse struct {
+	List []Serve `json:"list"`
+}
+
+func (c *Client) ServeStart(ctx context.Context, req ServeStartRequest) (*ServeStartResponse, error) {
+	var resp ServeStartResponse
+	if err := c.Call(ctx, "serve/start", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) ServeStop(ctx context.Context, id string) error {
+	return c.Call(ctx, "serve/stop", ServeStopRequest{Id: id}, nil)
+}
+
+func (c *Client) ServeList(ctx context.Context) ([]Serve, error) {
+	var resp ServeListResponse
+	if err := c.Call(ctx, "serve/list", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.List, nil
+}
@@ -0,0 +1,106 @@
+package rcclient
+
+import (
+	"context"
+	"fmt"
+)
+
+type VfsRefreshRequest struct {
+	Fs        string
+	Recursive bool
+	Dirs      []string
+}
+
+type VfsRefreshResponse struct {
+	Result map[string]string `json:"result"`
+}
+
+type VfsForgetRequest struct {
+	Fs    string
+	Files []string
+	Dirs  []string
+}
+
+type VfsForgetResponse struct {
+	Forgotten []string `json:"forgotten"`
+}
+
+type VfsStatsRequest struct {
+	Fs string `json:"fs,omitempty"`
+}
+
+type VfsDiskCache struct {
+	BytesUsed         int64  `json:"bytesUsed"`
+	ErroredFiles      int64  `json:"erroredFiles"`
+	Files             int64  `json:"files"`
+	HashType          int    `json:"hashType"`
+	OutOfSpace        bool   `json:"outOfSpace"`
+	Path              string `json:"path"`
+	PathMeta          string `json:"pathMeta"`
+	UploadsInProgress int64  `json:"uploadsInProgress"`
+	UploadsQueued     int64  `json:"uploadsQueued"`
+}
+
+type VfsMetadataCache struct {
+	Dirs  int64 `json:"dirs"`
+	Files int64 `json:"files"`
+}
+
+type VfsStats struct {
+	Fs            string                 `json:"fs"`
+	InUse         int                    `json:"inUse"`
+	DiskCache     *VfsDiskCache          `json:"diskCache,omitempty"`
+	MetadataCache *VfsMetadataCache      `json:"metadataCache,omitempty"`
+	Opt           map[string]interface{} `json:"opt,omitempty"`
+}
+
+func (c *Client) VfsRefresh(ctx context.Context, req VfsRefreshRequest) (*VfsRefreshResponse, error) {
+	params := make(map[string]interface{})
+	if req.Fs != "" {
+		params["fs"] = req.Fs
+	}
+	if req.Recursive {
+		params["recursive"] = true
+	}
+	addIndexed(params, "dir", req.Dirs)
+
+	var resp VfsRefreshResponse
+	if err := c.Call(ctx, "vfs/refresh", params, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) VfsForget(ctx context.Context, req VfsForgetRequest) (*VfsForgetResponse, error) {
+	params := make(map[string]interface{})
+	if req.Fs != "" {
+		params["fs"] = req.Fs
+	}
+	addIndexed(params, "file", req.Files)
+	addIndexed(params, "dir", req.Dirs)
+
+	var resp VfsForgetResponse
+	if err := c.Call(ctx, "vfs/forget", params, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) VfsStats(ctx context.Context, req VfsStatsRequest) (*VfsStats, error) {
+	var resp VfsStats
+	if err := c.Call(ctx, "vfs/stats", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// addIndexed encodes a list the way rclone's vfs calls expect it: dir, dir2, dir3...
+func addIndexed(params map[string]interface{}, key string, values []string) {
+	for i, value := range values {
+		if i == 0 {
+			params[key] = value
+		} else {
+			params[fmt.Sprintf("%s%d", key, i+1)] = value
+		}
+	}
+}
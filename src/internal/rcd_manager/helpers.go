@@ -0,0 +1,439 @@
+package rcd_manager
+
+import (
+	"context"
+	"errors"
+	"net"
+	"rclone-manager/internal/config"
+	"rclone-manager/internal/constants"
+	"rclone-manager/internal/environment"
+	"rclone-manager/internal/instance_tracker"
+	"rclone-manager/internal/mount_manager"
+	"rclone-manager/internal/mountinfo"
+	"rclone-manager/internal/rcclient"
+	"rclone-manager/internal/rclone_conf"
+	"rclone-manager/internal/spec"
+	"rclone-manager/internal/supervisor"
+	"rclone-manager/internal/unmount"
+	"strings"
+	"time"
+)
+
+// rcdSpec is how rcd is run, serving the RC API on addr.
+func rcdSpec(addr string, rcd config.RcdConfig) *spec.Spec {
+	args := []string{constants.Rcd, constants.RcAddr, addr}
+	if rcd.User != "" {
+		args = append(args, constants.RcUser, rcd.User, constants.RcPass, rcd.Pass)
+	} else {
+		args = append(args, constants.RcNoAuth)
+	}
+	return &spec.Spec{
+		Binary:      environment.GetEnvWithFallback(constants.RcloneBinaryNameEnvVar, constants.DefaultRcloneBinaryName),
+		Args:        args,
+		Environment: rcd.Environment,
+	}
+}
+
+func rcdAddr(conf *config.Config) string {
+	if conf.Rcd.Addr != "" {
+		return conf.Rcd.Addr
+	}
+	return environment.GetEnvWithFallback(constants.RcAddrEnvVar, constants.DefaultRcAddr)
+}
+
+// specChanged reports whether a unit rcd already runs was started from a
+// different spec than the one now desired.
+func (m *Manager) specChanged(name string, desired *spec.Spec) bool {
+	applied, ok := m.appliedSpecs[name]
+	if !ok || applied.Fingerprint() == desired.Fingerprint() {
+		return false
+	}
+	m.logger.Warn().
+		Str(constants.LogName, name).
+		Strs(constants.LogChanges, spec.Diff(applied, desired)).
+		Msg("Unit config changed, restarting...")
+	return true
+}
+
+func (m *Manager) reconcileUnits(ctx context.Context, conf *config.Config, remotes *rclone_conf.RcloneConf) {
+	m.reconcileMounts(ctx, conf, remotes)
+	m.reconcileServes(ctx, conf, remotes)
+
+	for name := range m.appliedSpecs {
+		if !config.IsMountInConfig(name, conf) && !config.IsServeInConfig(name, conf) {
+			delete(m.appliedSpecs, name)
+		}
+	}
+	m.forgetUnits(conf)
+	m.retryAt = m.nextRetry(time.Now())
+}
+
+func (m *Manager) reconcileMounts(ctx context.Context, conf *config.Config, remotes *rclone_conf.RcloneConf) {
+	listCtx, cancel := rcContext(ctx)
+	active, err := m.client().ListMounts(listCtx)
+	cancel()
+	if err != nil {
+		m.logger.Error().Err(err).Msg("Failed to list rcd mounts")
+		return
+	}
+
+	activeByMountPoint := make(map[string]rcclient.MountPoint)
+	for _, mount := range active {
+		activeByMountPoint[mount.MountPoint] = mount
+	}
+
+	now := time.Now()
+	desired := make(map[string]bool)
+	for _, mount := range conf.Mounts {
+		desired[mount.MountPoint] = true
+		fs := mount.Source()
+		mountSpec := spec.ForMount(constants.ModeRcd, mount, remotes)
+		unit := m.unit(mount.Name, mount.BackendName, constants.Mount, mount.Restart, mountSpec)
+
+		if existing, ok := activeByMountPoint[mount.MountPoint]; ok {
+			if err := m.lost(mount.MountPoint); err != nil {
+				m.logger.Warn().AnErr(constants.LogError, err).
+					Str(constants.LogName, mount.Name).
+					Str(constants.LogMountPoint, mount.MountPoint).
+					Msg("Mount is listed by rcd but no longer mounted, remounting...")
+				m.drop(ctx, existing.Fs, mount)
+				delete(m.appliedSpecs, mount.Name)
+				m.failed(unit, err, now)
+				continue
+			}
+			if m.refused[mount.Name] == mountSpec.Fingerprint() {
+				m.logger.Debug().Str(constants.LogName, mount.Name).Msg("Mount is busy, keeping it mounted as it is until the next reload")
+				continue
+			}
+			if sameFs(existing.Fs, fs) && !m.specChanged(mount.Name, mountSpec) {
+				m.appliedSpecs[mount.Name] = mountSpec
+				if unit.State != constants.StateReady {
+					m.started(unit, now)
+				}
+				m.logger.Debug().Str(constants.LogMountPoint, mount.MountPoint).Msg("Mount is mounted fine. Nothing to do.")
+				continue
+			}
+			m.logger.Warn().
+				Str(constants.LogName, mount.Name).
+				Str(constants.LogMountPoint, mount.MountPoint).
+				Msg("Mount config changed, remounting...")
+			if err := m.unmount(ctx, existing.Fs, mount); errors.Is(err, unmount.ErrBusy) {
+				m.refused[mount.Name] = mountSpec.Fingerprint()
+				if unit.State != constants.StateReady {
+					m.started(unit, now)
+				}
+				m.logger.Error().AnErr(constants.LogError, err).
+					Str(constants.LogName, mount.Name).
+					Msg("Mount is busy, keeping it mounted as it is until the next reload")
+				continue
+			}
+			delete(m.appliedSpecs, mount.Name)
+		} else if _, ok := m.appliedSpecs[mount.Name]; ok {
+			delete(m.appliedSpecs, mount.Name)
+			m.failed(unit, errGone, now)
+		}
+
+		if !m.attempt(unit, now) {
+			continue
+		}
+
+		// The mount runs in rcd, with its environment
+		mount.Environment = conf.Rcd.Environment
+		if err := m.mountPoints.Prepare(mount, m.logger); err != nil {
+			m.logger.Error().Err(err).
+				Str(constants.LogName, mount.Name).
+				Str(constants.LogMountPoint, mount.MountPoint).
+				Msg("Refusing to mount at the mount point")
+			m.failed(unit, err, now)
+			continue
+		}
+		request := rcclient.MountRequest{Fs: fs, MountPoint: mount.MountPoint}
+		if mount.AllowNonEmpty {
+			request.MountOpt = map[string]interface{}{"AllowNonEmpty": true}
+		}
+		mountCtx, cancel := rcContext(ctx)
+		err := m.client().Mount(mountCtx, request)
+		cancel()
+		if err == nil {
+			if err = m.lost(mount.MountPoint); err != nil {
+				m.drop(ctx, fs, mount)
+			}
+		}
+		if err != nil {
+			m.logger.Error().Err(err).
+				Str(constants.LogName, mount.Name).
+				Str(constants.LogMountPoint, mount.MountPoint).
+				Msg("Failed to mount via rcd")
+			m.failed(unit, err, now)
+			continue
+		}
+		m.logger.Info().
+			Str(constants.LogName, mount.Name).
+			Str(constants.LogMountPoint, mount.MountPoint).
+			Msg("Mount started successfully.")
+		m.appliedSpecs[mount.Name] = mountSpec
+		m.started(unit, now)
+	}
+
+	for _, mount := range active {
+		if !desired[mount.MountPoint] {
+			m.logger.Warn().
+				Str(constants.LogMountPoint, mount.MountPoint).
+				Msg("Mount removed from config, unmounting...")
+			_ = m.unmount(ctx, mount.Fs, mountConfig(conf, mount.MountPoint))
+		}
+	}
+}
+
+func (m *Manager) reconcileServes(ctx context.Context, conf *config.Config, remotes *rclone_conf.RcloneConf) {
+	listCtx, cancel := rcContext(ctx)
+	active, err := m.client().ServeList(listCtx)
+	cancel()
+	if err != nil {
+		m.logger.Error().Err(err).Msg("Failed to list rcd serves")
+		return
+	}
+
+	now := time.Now()
+	matched := make(map[string]bool)
+	for _, serve := range conf.Serves {
+		serveSpec := spec.ForServe(constants.ModeRcd, serve, remotes)
+		unit := m.unit(serve.Name, serve.BackendName, constants.Serve, serve.Restart, serveSpec)
+		found := false
+		for _, existing := range active {
+			if !matched[existing.Id] && serveMatches(existing, serve) {
+				matched[existing.Id] = true
+				found = true
+				if m.specChanged(serve.Name, serveSpec) {
+					m.stopServe(ctx, existing.Id)
+					delete(m.appliedSpecs, serve.Name)
+					found = false
+				}
+				break
+			}
+		}
+		if found {
+			m.appliedSpecs[serve.Name] = serveSpec
+			if unit.State != constants.StateReady {
+				m.started(unit, now)
+			}
+			m.logger.Debug().Str(constants.LogName, serve.Name).Msg("Serve is fine. Nothing to do.")
+			continue
+		}
+		if _, ok := m.appliedSpecs[serve.Name]; ok {
+			delete(m.appliedSpecs, serve.Name)
+			m.failed(unit, errGone, now)
+		}
+
+		if !m.attempt(unit, now) {
+			continue
+		}
+
+		startCtx, cancel := rcContext(ctx)
+		resp, err := m.client().ServeStart(startCtx, rcclient.ServeStartRequest{
+			Type: serve.Protocol,
+			Fs:   serve.Source(),
+			Addr: serve.Addr,
+		})
+		cancel()
+		if err != nil {
+			m.logger.Error().Err(err).
+				Str(constants.LogName, serve.Name).
+				Str(constants.LogProtocol, serve.Protocol).
+				Str(constants.LogAddr, serve.Addr).
+				Msg("Failed to start serve via rcd")
+			m.failed(unit, err, now)
+			continue
+		}
+		matched[resp.Id] = true
+		m.appliedSpecs[serve.Name] = serveSpec
+		m.started(unit, now)
+		m.logger.Info().
+			Str(constants.LogName, serve.Name).
+			Str(constants.LogProtocol, serve.Protocol).
+			Str(constants.LogAddr, resp.Addr).
+			Str(constants.LogServeId, resp.Id).
+			Msg("Serve started successfully.")
+	}
+
+	for _, existing := range active {
+		if !matched[existing.Id] {
+			m.logger.Warn().
+				Str(constants.LogServeId, existing.Id).
+				Str(constants.LogAddr, existing.Addr).
+				Msg("Serve removed from config, stopping...")
+			m.stopServe(ctx, existing.Id)
+		}
+	}
+}
+
+func serveMatches(existing rcclient.Serve, serve config.Serve) bool {
+	if existing.Params.Type != serve.Protocol || !sameFs(existing.Params.Fs, serve.Source()) {
+		return false
+	}
+	_, existingPort, err := net.SplitHostPort(existing.Addr)
+	if err != nil {
+		return existing.Addr == serve.Addr
+	}
+	_, wantPort, err := net.SplitHostPort(serve.Addr)
+	if err != nil {
+		return false
+	}
+	return existingPort == wantPort
+}
+
+// sameFs compares rclone fs strings the way rcd may normalise them, so
+// "remote:/path/" and "remote:path" are the same.
+func sameFs(a, b string) bool {
+	aName, aPath, _ := strings.Cut(a, ":")
+	bName, bPath, _ := strings.Cut(b, ":")
+	return aName == bName && strings.Trim(aPath, "/") == strings.Trim(bPath, "/")
+}
+
+// unmount applies the onBusy policy of the mount, then gives the VFS of fs up
+// to the stop timeout of the mount to finish pending uploads, as rclone drops
+// them when it is unmounted. Both give up once ctx is done.
+func (m *Manager) unmount(ctx context.Context, fs string, mount config.Mount) error {
+	if err := mount_manager.CheckBusy(ctx, mount.MountPoint, mount.OnBusy, mount.BusyTimeout, m.logger); err != nil {
+		return err
+	}
+	m.waitForUploads(ctx, fs, mount.StopTimeout)
+
+	unmountCtx, cancel := rcContext(ctx)
+	defer cancel()
+	if err := m.client().Unmount(unmountCtx, mount.MountPoint); err != nil {
+		m.logger.Warn().AnErr(constants.LogError, err).
+			Str(constants.LogMountPoint, mount.MountPoint).
+			Msg("Failed to unmount via rcd")
+		return err
+	}
+	m.logger.Info().Str(constants.LogMountPoint, mount.MountPoint).Msg("Unmounted successfully.")
+	return nil
+}
+
+// lost returns an error wrapping supervisor.ErrLost unless rclone's FUSE
+// filesystem shows up at mountPoint in mountinfo, as rcd keeps listing a mount
+// whose filesystem went away. When mountinfo cannot be read, rcd is trusted.
+func (m *Manager) lost(mountPoint string) error {
+	err := mount_manager.Mounted(mountinfo.Path(), mountPoint)
+	if err != nil && !errors.Is(err, supervisor.ErrLost) {
+		m.logger.Debug().AnErr(constants.LogError, err).Str(constants.LogMountPoint, mountPoint).
+			Msg("Failed to read mountinfo, not checking that the mount is mounted")
+		return nil
+	}
+	return err
+}
+
+// drop has rcd forget a mount that is no longer mounted, once the VFS of fs
+// finished its pending uploads. There are no holders left to wait for.
+func (m *Manager) drop(ctx context.Context, fs string, mount config.Mount) {
+	m.waitForUploads(ctx, fs, mount.StopTimeout)
+
+	unmountCtx, cancel := rcContext(ctx)
+	defer cancel()
+	if err := m.client().Unmount(unmountCtx, mount.MountPoint); err != nil {
+		m.logger.Warn().AnErr(constants.LogError, err).
+			Str(constants.LogMountPoint, mount.MountPoint).
+			Msg("Failed to unmount via rcd")
+	}
+}
+
+// mountConfig returns the config of the mount at mountPoint, or the top level
+// defaults for a mount that is no longer configured.
+func mountConfig(conf *config.Config, mountPoint string) config.Mount {
+	for _, mount := range conf.Mounts {
+		if mount.MountPoint == mountPoint {
+			return mount
+		}
+	}
+	return config.Mount{
+		MountPoint:  mountPoint,
+		StopTimeout: conf.StopTimeout,
+		OnBusy:      conf.OnBusy,
+		BusyTimeout: conf.BusyTimeout,
+	}
+}
+
+// stopServe stops the serve id with an RC call of its own, which ends with parent.
+func (m *Manager) stopServe(parent context.Context, id string) {
+	ctx, cancel := rcContext(parent)
+	defer cancel()
+	if err := m.client().ServeStop(ctx, id); err != nil {
+		m.logger.Warn().AnErr(constants.LogError, err).
+			Str(constants.LogServeId, id).
+			Msg("Failed to stop serve via rcd")
+		return
+	}
+	m.logger.Info().Str(constants.LogServeId, id).Msg("Serve stopped")
+}
+
+func (m *Manager) stopAllServes(ctx context.Context) {
+	active, err := m.client().ServeList(ctx)
+	if err != nil {
+		m.logger.Warn().AnErr(constants.LogError, err).Msg("Failed to list rcd serves")
+		return
+	}
+	for _, serve := range active {
+		m.stopServe(ctx, serve.Id)
+	}
+}
+
+// unmountAll waits, up to timeout for all of them together, for every mount to
+// finish its pending uploads before unmounting them all.
+func (m *Manager) unmountAll(ctx context.Context, timeout time.Duration) {
+	if active, err := m.client().ListMounts(ctx); err == nil {
+		deadline := time.Now().Add(timeout)
+		busyCtx, cancel := context.WithDeadline(ctx, deadline)
+		defer cancel()
+		for _, mount := range active {
+			busy := mountConfig(m.desiredConfig, mount.MountPoint)
+			// Shutting down cannot be refused, the busy check only reports and waits
+			_ = mount_manager.CheckBusy(busyCtx, mount.MountPoint, busy.OnBusy, busy.BusyTimeout, m.logger)
+			m.waitForUploads(ctx, mount.Fs, instance_tracker.TimeoutWithin(timeout, deadline))
+		}
+	}
+
+	if err := m.client().UnmountAll(ctx); err != nil {
+		m.logger.Warn().AnErr(constants.LogError, err).Msg("Failed to unmount all via rcd")
+	}
+}
+
+// Pending uploads are polled every uploadPollInterval, each poll bounded by
+// uploadPollTimeout.
+const (
+	uploadPollInterval = time.Second
+	uploadPollTimeout  = 5 * time.Second
+)
+
+// waitForUploads polls vfs/stats until fs has no uploads pending or timeout
+// passes, and reports what is left. It gives up once ctx is done.
+func (m *Manager) waitForUploads(ctx context.Context, fs string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		pollCtx, cancel := context.WithTimeout(ctx, uploadPollTimeout)
+		pending, err := instance_tracker.PendingUploads(pollCtx, m.client(), fs)
+		cancel()
+		if err != nil {
+			m.logger.Debug().AnErr(constants.LogError, err).Str(constants.LogFs, fs).Msg("Failed to read vfs stats")
+			return
+		}
+		if pending == 0 {
+			return
+		}
+		if !time.Now().Before(deadline) {
+			m.logger.Error().Str(constants.LogFs, fs).
+				Int64(constants.LogPendingUploads, pending).
+				Msg("Uploads still pending after the stop timeout, they may be lost")
+			return
+		}
+
+		m.logger.Warn().Str(constants.LogFs, fs).
+			Int64(constants.LogPendingUploads, pending).
+			Msg("Waiting for pending uploads before unmounting")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(min(uploadPollInterval, time.Until(deadline))):
+		}
+	}
+}
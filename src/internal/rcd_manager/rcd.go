@@ -0,0 +1,251 @@
+package rcd_manager
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"os/exec"
+	"rclone-manager/internal/circuit_breaker"
+	"rclone-manager/internal/config"
+	"rclone-manager/internal/constants"
+	"rclone-manager/internal/instance_tracker"
+	"rclone-manager/internal/mount_manager"
+	"rclone-manager/internal/rcclient"
+	"rclone-manager/internal/rclone_conf"
+	"rclone-manager/internal/spec"
+	"rclone-manager/internal/status"
+	"rclone-manager/internal/supervisor"
+	"time"
+)
+
+// RcdProcess is the supervisor unit of rclone rcd. It is ready once its RC
+// API answers, and takes the mounts and serves it runs down with it.
+type RcdProcess struct {
+	instance_tracker.RcloneProcess
+	Addr   string
+	client *rcclient.Client
+
+	manager *Manager
+}
+
+func (p *RcdProcess) Process() *instance_tracker.RcloneProcess {
+	return &p.RcloneProcess
+}
+
+func (p *RcdProcess) Command() *exec.Cmd {
+	return supervisor.NewCommand(p.Spec)
+}
+
+func (p *RcdProcess) PreStart() error {
+	return nil
+}
+
+// PreStop stops every serve and unmounts every mount through the RC API, as
+// rcd drops them without waiting for pending uploads when it exits.
+func (p *RcdProcess) PreStop(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.StopTimeout)
+		defer cancel()
+	}
+	p.manager.teardown(ctx)
+	return nil
+}
+
+// PostStop unmounts whatever rcd left behind, e.g. because it crashed.
+func (p *RcdProcess) PostStop() {
+	p.manager.forget()
+}
+
+func (p *RcdProcess) Refresh(desired supervisor.Unit) {
+	rcd := desired.(*RcdProcess)
+	p.Restart = rcd.Restart
+	p.StopTimeout = rcd.StopTimeout
+	// The timeout of RC calls only lives in the client
+	p.client = rcd.client
+}
+
+// Checks gives rcd as long to answer after a start as it always had, and
+// restarts it once its RC API stopped answering.
+func (p *RcdProcess) Checks() supervisor.Checks {
+	return supervisor.Checks{
+		Ready:            p.client.Noop,
+		Period:           constants.ReadyCheckInterval,
+		Timeout:          constants.ReadyCheckTimeout,
+		FailureThreshold: 3,
+		StartupTimeout:   30 * time.Second,
+	}
+}
+
+func (p *RcdProcess) MarshalZerologObject(e *zerolog.Event) {
+	e.Str(constants.LogAddr, p.Addr)
+}
+
+// Manager runs rclone rcd on a supervisor and drives every mount and serve
+// through its RC API once it is ready.
+type Manager struct {
+	*supervisor.Supervisor
+	rcd            *RcdProcess
+	synced         bool
+	desiredConfig  *config.Config
+	desiredRemotes *rclone_conf.RcloneConf
+	appliedSpecs   map[string]*spec.Spec
+	units          map[string]*rcdUnit
+	// refused holds the fingerprint of a spec change that was not applied
+	// because the mount was busy, it is tried again on the next reload
+	refused map[string]string
+	retryAt time.Time
+
+	mountPoints mount_manager.MountPoints
+	breakers    *circuit_breaker.Breakers
+	status      *status.Recorder
+	logger      zerolog.Logger
+}
+
+func NewManager(events *instance_tracker.ExitEvents, breakers *circuit_breaker.Breakers, recorder *status.Recorder, logger zerolog.Logger) *Manager {
+	return &Manager{
+		Supervisor:   supervisor.New(constants.Rcd, events, breakers, recorder, logger),
+		appliedSpecs: make(map[string]*spec.Spec),
+		units:        make(map[string]*rcdUnit),
+		refused:      make(map[string]string),
+		breakers:     breakers,
+		status:       recorder,
+		logger:       logger,
+	}
+}
+
+// Initialize starts rcd, its mounts and serves follow once it is ready.
+func (m *Manager) Initialize(ctx context.Context, conf *config.Config, remotes *rclone_conf.RcloneConf) {
+	m.logger.Info().Msg("Initializing rclone rcd")
+	cleanupCtx, cancel := context.WithTimeout(ctx, conf.ShutdownTimeout)
+	m.Cleanup(cleanupCtx, conf)
+	cancel()
+
+	m.desiredConfig = conf
+	m.desiredRemotes = remotes
+	m.rcd = m.newRcdProcess(conf)
+	m.Apply(ctx, []supervisor.Unit{m.rcd})
+}
+
+// Cleanup stops every serve and mount and then rcd itself, no later than the
+// deadline of ctx.
+func (m *Manager) Cleanup(ctx context.Context, conf *config.Config) {
+	m.logger.Info().Msg("Cleaning up rclone rcd")
+	m.StopAll(ctx)
+	clear(m.appliedSpecs)
+
+	if m.rcd == nil {
+		// Stopping rcd unmounts what it leaves behind, only a previous run is left
+		mount_manager.UnmountAllByPath(conf, m.logger)
+	}
+}
+
+// Reconcile brings the mounts and serves of rcd in line with conf, or leaves
+// that to when rcd is ready. A changed rcd section restarts rcd.
+func (m *Manager) Reconcile(ctx context.Context, conf *config.Config, remotes *rclone_conf.RcloneConf) {
+	m.logger.Info().Msg("Reconciling rcd mounts and serves...")
+
+	m.desiredConfig = conf
+	m.desiredRemotes = remotes
+	clear(m.refused)
+	desired := m.newRcdProcess(conf)
+	changed := m.rcd.Spec.Fingerprint() != desired.Spec.Fingerprint()
+	m.Apply(ctx, []supervisor.Unit{desired})
+	if ctx.Err() != nil {
+		return
+	}
+	if changed {
+		// The restarted rcd reconciles once it is ready
+		m.rcd = desired
+		return
+	}
+	if !m.synced {
+		m.logger.Info().Msg("Rcd is not ready yet, its mounts and serves follow once it is")
+		return
+	}
+	m.reconcileUnits(ctx, conf, remotes)
+}
+
+// Tick runs the supervisor of rcd and reconciles the mounts and serves once
+// rcd became ready, or once a failed one is due for a retry. It returns the
+// checks of rcd that are due and when it has to run again.
+func (m *Manager) Tick(ctx context.Context) ([]*supervisor.Check, time.Time) {
+	checks, next := m.Supervisor.Tick()
+	if m.rcd == nil || m.rcd.State != constants.StateReady {
+		return checks, next
+	}
+	switch {
+	case !m.synced:
+		m.synced = true
+		m.reconcileUnits(ctx, m.desiredConfig, m.desiredRemotes)
+	case !m.retryAt.IsZero() && !time.Now().Before(m.retryAt):
+		m.reconcileUnits(ctx, m.desiredConfig, m.desiredRemotes)
+	}
+	return checks, instance_tracker.Earliest(next, m.retryAt)
+}
+
+// Resync brings the mounts and serves of a running rcd back in line with the
+// config, e.g. after rclone dropped one.
+func (m *Manager) Resync(ctx context.Context) {
+	if !m.synced || m.rcd.State != constants.StateReady || time.Since(m.rcd.StartedAt) < m.rcd.Restart.GracePeriod {
+		return
+	}
+	m.logger.Debug().Msg("Checking rcd mounts and serves...")
+	m.reconcileUnits(ctx, m.desiredConfig, m.desiredRemotes)
+}
+
+func (m *Manager) newRcdProcess(conf *config.Config) *RcdProcess {
+	addr := rcdAddr(conf)
+	return &RcdProcess{
+		Addr: addr,
+		client: rcclient.NewClient(addr, rcclient.Options{
+			User:    conf.Rcd.User,
+			Pass:    conf.Rcd.Pass,
+			Timeout: conf.Rcd.Timeout,
+		}),
+		manager: m,
+		RcloneProcess: instance_tracker.RcloneProcess{
+			Name:        constants.Rcd,
+			Environment: conf.Rcd.Environment,
+			Spec:        rcdSpec(addr, conf.Rcd),
+			Restart:     conf.Restart,
+			StopTimeout: conf.StopTimeout,
+		},
+	}
+}
+
+// client is the RC API of the running rcd.
+func (m *Manager) client() *rcclient.Client {
+	return m.rcd.client
+}
+
+// teardown stops every serve and unmounts every mount of a ready rcd, no
+// later than the deadline of ctx.
+func (m *Manager) teardown(ctx context.Context) {
+	if !m.synced {
+		return
+	}
+	deadline, _ := ctx.Deadline()
+	m.stopAllServes(ctx)
+	m.unmountAll(ctx, instance_tracker.TimeoutWithin(m.desiredConfig.StopTimeout, deadline))
+	m.synced = false
+}
+
+// forget drops what rcd ran once it is gone, and unmounts what it left behind.
+func (m *Manager) forget() {
+	if m.synced {
+		m.logger.Warn().Msg("Rcd is gone, unmounting what it left behind")
+	}
+	m.synced = false
+	clear(m.appliedSpecs)
+	clear(m.refused)
+	m.forgetUnits(nil)
+	m.retryAt = time.Time{}
+	if m.desiredConfig != nil {
+		mount_manager.UnmountAllByPath(m.desiredConfig, m.logger)
+	}
+}
+
+// rcContext bounds a single RC call, which also ends with parent.
+func rcContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, 30*time.Second)
+}
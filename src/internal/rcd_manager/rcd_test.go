@@ -0,0 +1,424 @@
+package rcd_manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"rclone-manager/internal/circuit_breaker"
+	"rclone-manager/internal/config"
+	"rclone-manager/internal/constants"
+	"rclone-manager/internal/instance_tracker"
+	"rclone-manager/internal/rcclient"
+	"rclone-manager/internal/rclone_conf"
+	"rclone-manager/internal/status"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRcd answers the RC API calls the manager makes, keeping mounts and
+// serves in memory. Its mounts are written to the mountinfo file, except
+// those it lost.
+type fakeRcd struct {
+	mu        sync.Mutex
+	mountinfo string
+	mounts    map[string]string
+	lost      map[string]bool
+	serves    map[string]rcclient.Serve
+	calls     []string
+	fail      map[string]bool
+	nextId    int
+}
+
+func newFakeRcd(t *testing.T, mountinfo string) (*fakeRcd, string) {
+	fake := &fakeRcd{
+		mountinfo: mountinfo,
+		mounts:    make(map[string]string),
+		lost:      make(map[string]bool),
+		serves:    make(map[string]rcclient.Serve),
+		fail:      make(map[string]bool),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server.URL
+}
+
+func (f *fakeRcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	method := r.URL.Path[1:]
+	f.calls = append(f.calls, method)
+	if f.fail[method] {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": "failed", "status": 500})
+		return
+	}
+
+	var out interface{} = struct{}{}
+	defer f.writeMountinfoLocked()
+	switch method {
+	case "mount/listmounts":
+		var resp rcclient.ListMountsResponse
+		for mountPoint, fs := range f.mounts {
+			resp.MountPoints = append(resp.MountPoints, rcclient.MountPoint{Fs: fs, MountPoint: mountPoint})
+		}
+		out = resp
+	case "mount/mount":
+		var req rcclient.MountRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		f.mounts[req.MountPoint] = req.Fs
+	case "mount/unmount":
+		var req rcclient.UnmountRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		delete(f.mounts, req.MountPoint)
+	case "mount/unmountall":
+		clear(f.mounts)
+	case "serve/list":
+		var resp rcclient.ServeListResponse
+		for _, serve := range f.serves {
+			resp.List = append(resp.List, serve)
+		}
+		out = resp
+	case "serve/start":
+		var req rcclient.ServeStartRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		f.nextId++
+		id := fmt.Sprintf("%s-%d", req.Type, f.nextId)
+		f.serves[id] = rcclient.Serve{Id: id, Addr: req.Addr, Params: rcclient.ServeParams{Type: req.Type, Fs: req.Fs}}
+		out = rcclient.ServeStartResponse{Id: id, Addr: req.Addr}
+	case "serve/stop":
+		var req rcclient.ServeStopRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		delete(f.serves, req.Id)
+	case "vfs/stats", "rc/noop":
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+func (f *fakeRcd) writeMountinfoLocked() {
+	var lines strings.Builder
+	id := 100
+	for mountPoint, fs := range f.mounts {
+		if !f.lost[mountPoint] {
+			id++
+			fmt.Fprintf(&lines, "%d 1 0:%d / %s rw - fuse.rclone %s rw\n", id, id, mountPoint, fs)
+		}
+	}
+	_ = os.WriteFile(f.mountinfo, []byte(lines.String()), 0o644)
+}
+
+// lose drops the FUSE filesystem at mountPoint from mountinfo, while rcd
+// keeps listing the mount.
+func (f *fakeRcd) lose(mountPoint string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lost[mountPoint] = true
+	f.writeMountinfoLocked()
+}
+
+// count returns how often method was called.
+func (f *fakeRcd) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, call := range f.calls {
+		if call == method {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeRcd) mounted() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return maps.Clone(f.mounts)
+}
+
+func (f *fakeRcd) served() []rcclient.Serve {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var serves []rcclient.Serve
+	for _, serve := range f.serves {
+		serves = append(serves, serve)
+	}
+	return serves
+}
+
+// setup points a manager at a fake rcd and returns the directory mount points
+// go to. Mountinfo lists what the fake rcd mounted.
+func setup(t *testing.T) (*Manager, *fakeRcd, string, string) {
+	dir := t.TempDir()
+	mountinfo := filepath.Join(dir, "mountinfo")
+	if err := os.WriteFile(mountinfo, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(constants.MountinfoEnvVar, mountinfo)
+
+	fake, url := newFakeRcd(t, mountinfo)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	events := instance_tracker.NewExitEvents(ctx)
+	recorder := status.NewRecorder("")
+	m := NewManager(events, circuit_breaker.NewBreakers(recorder), recorder, zerolog.Nop())
+	return m, fake, url, dir
+}
+
+// attach drives the mounts and serves of an rcd that already answers at the
+// address of conf instead of starting one.
+func (m *Manager) attach(conf *config.Config, remotes *rclone_conf.RcloneConf) {
+	m.desiredConfig = conf
+	m.desiredRemotes = remotes
+	m.rcd = m.newRcdProcess(conf)
+	m.rcd.State = constants.StateReady
+	m.synced = true
+}
+
+func loadConfig(t *testing.T, url, yaml string) *config.Config {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("mode: rcd\n"+yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := config.LoadConfigFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Rcd.Addr = url
+	return conf
+}
+
+func TestReconcileCreatesMountsAndServes(t *testing.T) {
+	m, fake, url, dir := setup(t)
+	mountPoint := filepath.Join(dir, "a")
+	conf := loadConfig(t, url, fmt.Sprintf(`
+mounts:
+  - backendName: A
+    remotePath: data
+    mountPoint: %s
+serves:
+  - backendName: B
+    protocol: webdav
+    addr: 127.0.0.1:8080
+`, mountPoint))
+	remotes := rclone_conf.Parse([]byte("[A]\ntype = local\n[B]\ntype = local\n"))
+
+	m.attach(conf, remotes)
+	m.reconcileUnits(context.Background(), conf, remotes)
+
+	if got := fake.mounted(); got[mountPoint] != "A:data" || len(got) != 1 {
+		t.Fatalf("mounts = %v, want A:data at %s", got, mountPoint)
+	}
+	serves := fake.served()
+	if len(serves) != 1 || serves[0].Params.Type != "webdav" || serves[0].Params.Fs != "B:" || serves[0].Addr != "127.0.0.1:8080" {
+		t.Fatalf("serves = %+v, want one webdav serve of B: on 127.0.0.1:8080", serves)
+	}
+	if info, err := os.Stat(mountPoint); err != nil || !info.IsDir() {
+		t.Fatalf("mount point was not created: %v", err)
+	}
+
+	// Nothing changed, so a resync leaves both alone
+	m.Resync(context.Background())
+	if n := fake.count("mount/mount"); n != 1 {
+		t.Errorf("mount/mount called %d times, want 1", n)
+	}
+	if n := fake.count("serve/start"); n != 1 {
+		t.Errorf("serve/start called %d times, want 1", n)
+	}
+	for _, name := range []string{conf.Mounts[0].Name, conf.Serves[0].Name} {
+		if state := m.units[name].State; state != constants.StateReady {
+			t.Errorf("state of %s = %q, want %q", name, state, constants.StateReady)
+		}
+	}
+}
+
+func TestReconcileRemountsOnSpecChange(t *testing.T) {
+	m, fake, url, dir := setup(t)
+	mountPoint := filepath.Join(dir, "a")
+	yaml := `
+mounts:
+  - backendName: A
+    mountPoint: %s
+    remotePath: %s
+serves:
+  - backendName: A
+    protocol: http
+    addr: 127.0.0.1:8080
+`
+	conf := loadConfig(t, url, fmt.Sprintf(yaml, mountPoint, ""))
+	remotes := rclone_conf.Parse([]byte("[A]\ntype = local\n"))
+	m.attach(conf, remotes)
+	m.reconcileUnits(context.Background(), conf, remotes)
+	before := fake.served()
+
+	// The same mount and serve of a remote whose rclone.conf section changed
+	changed := rclone_conf.Parse([]byte("[A]\ntype = local\ncopy_links = true\n"))
+	m.reconcileUnits(context.Background(), conf, changed)
+
+	if n := fake.count("mount/unmount"); n != 1 {
+		t.Errorf("mount/unmount called %d times, want 1", n)
+	}
+	if n := fake.count("mount/mount"); n != 2 {
+		t.Errorf("mount/mount called %d times, want 2", n)
+	}
+	if got := fake.mounted(); got[mountPoint] != "A:" {
+		t.Errorf("mounts = %v, want A: at %s", got, mountPoint)
+	}
+	after := fake.served()
+	if n := fake.count("serve/stop"); n != 1 || len(after) != 1 || after[0].Id == before[0].Id {
+		t.Errorf("serve was not restarted: stopped %d times, before %+v, after %+v", n, before, after)
+	}
+
+	// A changed remote path remounts as well
+	conf = loadConfig(t, url, fmt.Sprintf(yaml, mountPoint, "sub"))
+	m.reconcileUnits(context.Background(), conf, changed)
+	if got := fake.mounted(); got[mountPoint] != "A:sub" || len(got) != 1 {
+		t.Errorf("mounts = %v, want A:sub at %s", got, mountPoint)
+	}
+}
+
+func TestReconcileTearsDownStaleUnits(t *testing.T) {
+	m, fake, url, dir := setup(t)
+	stale := filepath.Join(dir, "stale")
+	fake.mounts[stale] = "Old:"
+	fake.serves["http-0"] = rcclient.Serve{Id: "http-0", Addr: "127.0.0.1:9090", Params: rcclient.ServeParams{Type: "http", Fs: "Old:"}}
+
+	mountPoint := filepath.Join(dir, "a")
+	conf := loadConfig(t, url, fmt.Sprintf(`
+mounts:
+  - backendName: A
+    mountPoint: %s
+`, mountPoint))
+	remotes := rclone_conf.Parse([]byte("[A]\ntype = local\n"))
+	m.attach(conf, remotes)
+	m.reconcileUnits(context.Background(), conf, remotes)
+
+	got := fake.mounted()
+	if _, ok := got[stale]; ok {
+		t.Errorf("stale mount at %s was not unmounted: %v", stale, got)
+	}
+	if got[mountPoint] != "A:" {
+		t.Errorf("mounts = %v, want A: at %s", got, mountPoint)
+	}
+	if serves := fake.served(); len(serves) != 0 {
+		t.Errorf("stale serves were not stopped: %+v", serves)
+	}
+
+	// A mount removed from the config is unmounted and no longer tracked
+	name := conf.Mounts[0].Name
+	conf = loadConfig(t, url, "mounts: []\n")
+	m.reconcileUnits(context.Background(), conf, remotes)
+	if got := fake.mounted(); len(got) != 0 {
+		t.Errorf("mounts = %v, want none", got)
+	}
+	if _, ok := m.units[name]; ok {
+		t.Errorf("%s is still tracked after it was removed from the config", name)
+	}
+}
+
+func TestReconcileBacksOffFailedMount(t *testing.T) {
+	m, fake, url, dir := setup(t)
+	fake.fail["mount/mount"] = true
+	conf := loadConfig(t, url, fmt.Sprintf(`
+restart:
+  initialBackoff: 1h
+  maxBackoff: 1h
+mounts:
+  - backendName: A
+    mountPoint: %s
+`, filepath.Join(dir, "a")))
+	remotes := rclone_conf.Parse([]byte("[A]\ntype = local\n"))
+	m.attach(conf, remotes)
+
+	m.reconcileUnits(context.Background(), conf, remotes)
+	m.Resync(context.Background())
+	m.Resync(context.Background())
+
+	if n := fake.count("mount/mount"); n != 1 {
+		t.Errorf("mount/mount called %d times, want 1 until the backoff passed", n)
+	}
+	unit := m.units[conf.Mounts[0].Name]
+	if unit.State != constants.StatePending || unit.NextAttempt.IsZero() {
+		t.Errorf("state = %q, next attempt %v, want a pending retry", unit.State, unit.NextAttempt)
+	}
+}
+
+func TestReconcileRemountsWhatIsNotInMountinfo(t *testing.T) {
+	m, fake, url, dir := setup(t)
+	mountPoint := filepath.Join(dir, "a")
+	conf := loadConfig(t, url, fmt.Sprintf(`
+restart:
+  initialBackoff: 1ms
+  maxBackoff: 1ms
+  jitter: 0
+mounts:
+  - backendName: A
+    mountPoint: %s
+`, mountPoint))
+	remotes := rclone_conf.Parse([]byte("[A]\ntype = local\n"))
+	m.attach(conf, remotes)
+	unit := func() *rcdUnit {
+		return m.units[conf.Mounts[0].Name]
+	}
+	retry := func() {
+		time.Sleep(5 * time.Millisecond)
+		m.Resync(context.Background())
+	}
+
+	// A mount that never shows up is not ready
+	fake.lost[mountPoint] = true
+	m.reconcileUnits(context.Background(), conf, remotes)
+	if state := unit().State; state != constants.StatePending {
+		t.Fatalf("state = %q while nothing is mounted, want %q", state, constants.StatePending)
+	}
+	if n := fake.count("mount/unmount"); n != 1 {
+		t.Errorf("mount/unmount called %d times, want 1 to drop the mount", n)
+	}
+
+	delete(fake.lost, mountPoint)
+	retry()
+	if state := unit().State; state != constants.StateReady {
+		t.Fatalf("state = %q, want %q once mounted", state, constants.StateReady)
+	}
+
+	// A mount rcd still lists after it disappeared is remounted
+	fake.lose(mountPoint)
+	m.Resync(context.Background())
+	if state := unit().State; state != constants.StatePending {
+		t.Fatalf("state = %q after the mount disappeared, want %q", state, constants.StatePending)
+	}
+	delete(fake.lost, mountPoint)
+	retry()
+	if n := fake.count("mount/mount"); n != 3 {
+		t.Errorf("mount/mount called %d times, want 3", n)
+	}
+	if state := unit().State; state != constants.StateReady {
+		t.Errorf("state = %q, want %q once remounted", state, constants.StateReady)
+	}
+}
+
+func TestRefreshTakesOverTimeout(t *testing.T) {
+	m, _, url, _ := setup(t)
+	conf := loadConfig(t, url, "")
+	running := m.newRcdProcess(conf)
+
+	reloaded := loadConfig(t, url, "rcd:\n  timeout: 5m\n")
+	desired := m.newRcdProcess(reloaded)
+	if running.Spec.Fingerprint() != desired.Spec.Fingerprint() {
+		t.Fatal("a changed timeout changed the spec of rcd, which restarts it")
+	}
+	running.Refresh(desired)
+	if running.client != desired.client {
+		t.Error("Refresh kept the client with the old timeout")
+	}
+}
@@ -0,0 +1,111 @@
+package rcd_manager
+
+import (
+	"errors"
+	"rclone-manager/internal/config"
+	"rclone-manager/internal/constants"
+	"rclone-manager/internal/instance_tracker"
+	"rclone-manager/internal/spec"
+	"time"
+)
+
+// errGone is the failure of a mount or serve rcd stopped listing on its own.
+var errGone = errors.New("no longer listed by rcd")
+
+// rcdUnit is a mount or serve rcd runs. It has no process of its own, but
+// failed RC calls back off and trip the breaker of its backend the same way
+// the exit of a process does.
+type rcdUnit struct {
+	instance_tracker.RcloneProcess
+	kind string
+}
+
+// unit returns the state of the mount or serve name, which starts over once
+// its spec changed.
+func (m *Manager) unit(name, backend, kind string, restart config.RestartConfig, desired *spec.Spec) *rcdUnit {
+	u, ok := m.units[name]
+	if !ok || u.Spec.Fingerprint() != desired.Fingerprint() {
+		u = &rcdUnit{
+			RcloneProcess: instance_tracker.RcloneProcess{Name: name, BackendName: backend, Spec: desired},
+			kind:          kind,
+		}
+		m.units[name] = u
+	}
+	u.Restart = restart
+	return u
+}
+
+// attempt reports whether the unit may be mounted or started now, which it
+// may until a failure scheduled a retry.
+func (m *Manager) attempt(u *rcdUnit, now time.Time) bool {
+	if u.GaveUp {
+		return false
+	}
+	if u.NextAttempt.IsZero() {
+		return true
+	}
+	_, due := u.Due(now, m.breakers, m.logger)
+	m.publish(u)
+	return due
+}
+
+func (m *Manager) started(u *rcdUnit, now time.Time) {
+	u.StartedAt = now
+	u.Exited = false
+	u.ExitErr = nil
+	u.State = constants.StateReady
+	m.publish(u)
+}
+
+// failed schedules the next attempt of a unit whose RC call failed, according
+// to its restart policy.
+func (m *Manager) failed(u *rcdUnit, err error, now time.Time) {
+	u.Exited = true
+	u.ExitErr = err
+	// A unit that stayed up for as long as the longest backoff recovered
+	if !u.StartedAt.IsZero() && now.Sub(u.StartedAt) >= u.Restart.MaxBackoff {
+		u.Failures = 0
+	}
+	u.StartedAt = time.Time{}
+
+	next, ok := u.ScheduleRestart(now)
+	m.publish(u)
+	if !ok {
+		m.logger.Error().AnErr(constants.LogError, err).
+			Str(constants.LogName, u.Name).
+			Str(constants.LogPolicy, u.Restart.Policy).
+			Msg("Unit failed, not retrying due to restart policy")
+		return
+	}
+	m.logger.Warn().AnErr(constants.LogError, err).
+		Str(constants.LogName, u.Name).
+		Dur(constants.LogBackoff, next.Sub(now)).
+		Int(constants.LogRestarts, len(u.Restarts)).
+		Msg("Unit failed, scheduling retry")
+}
+
+// nextRetry returns the earliest retry still ahead, retries held back by a
+// breaker are picked up by the next resync.
+func (m *Manager) nextRetry(now time.Time) time.Time {
+	var next time.Time
+	for _, u := range m.units {
+		if u.NextAttempt.After(now) {
+			next = instance_tracker.Earliest(next, u.NextAttempt)
+		}
+	}
+	return next
+}
+
+// forgetUnits drops the state of every unit, or of those no longer in conf.
+func (m *Manager) forgetUnits(conf *config.Config) {
+	for name := range m.units {
+		if conf == nil || (!config.IsMountInConfig(name, conf) && !config.IsServeInConfig(name, conf)) {
+			delete(m.units, name)
+			m.status.RemoveUnit(name)
+		}
+	}
+}
+
+func (m *Manager) publish(u *rcdUnit) {
+	m.status.SetUnit(u.Name, u.kind, u.State)
+}
@@ -0,0 +1,219 @@
+package rclone_conf
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"os"
+	"rclone-manager/internal/constants"
+	"rclone-manager/internal/environment"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ManagedKeys are written by rclone itself, e.g. when it refreshes an OAuth
+// token, so changes to them alone never mean the remote was reconfigured.
+var ManagedKeys = []string{"token", "expiry", "access_token", "refresh_token"}
+
+type RcloneConf struct {
+	Remotes map[string]map[string]string
+}
+
+func Path() string {
+	return environment.GetEnvWithFallback(constants.RcloneConfEnvVar, constants.DefaultRcloneConf)
+}
+
+func Load(path string) (*RcloneConf, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data), nil
+}
+
+func Parse(data []byte) *RcloneConf {
+	conf := &RcloneConf{Remotes: make(map[string]map[string]string)}
+
+	var current map[string]string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			current = make(map[string]string)
+			conf.Remotes[name] = current
+			continue
+		}
+
+		if current == nil {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		current[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	return conf
+}
+
+// Section returns the keys configured for a remote, or nil when the remote is
+// not defined in rclone.conf (it may still be defined through environment variables).
+func (c *RcloneConf) Section(name string) map[string]string {
+	if c == nil {
+		return nil
+	}
+	return c.Remotes[name]
+}
+
+// Dependencies returns the remotes a wrapping remote (crypt, alias, union,
+// combine, chunker, ...) refers to directly.
+func (c *RcloneConf) Dependencies(name string) []string {
+	section := c.Section(name)
+	if section == nil {
+		return nil
+	}
+
+	var deps []string
+	if remote, ok := section["remote"]; ok {
+		if dep := remoteName(remote); dep != "" {
+			deps = append(deps, dep)
+		}
+	}
+	if upstreams, ok := section["upstreams"]; ok {
+		for _, upstream := range strings.Fields(upstreams) {
+			// combine uses dir=remote:path, union uses remote:path[:mode]
+			if _, target, found := strings.Cut(upstream, "="); found {
+				upstream = target
+			}
+			if dep := remoteName(upstream); dep != "" {
+				deps = append(deps, dep)
+			}
+		}
+	}
+
+	sort.Strings(deps)
+	return slices.Compact(deps)
+}
+
+// Closure returns the remote and every remote it depends on transitively, sorted.
+func (c *RcloneConf) Closure(name string) []string {
+	seen := make(map[string]bool)
+	var visit func(string)
+	visit = func(remote string) {
+		if seen[remote] {
+			return
+		}
+		seen[remote] = true
+		for _, dep := range c.Dependencies(remote) {
+			visit(dep)
+		}
+	}
+	visit(name)
+
+	remotes := make([]string, 0, len(seen))
+	for remote := range seen {
+		remotes = append(remotes, remote)
+	}
+	sort.Strings(remotes)
+	return remotes
+}
+
+// SectionHash hashes a single remote section, ignoring ManagedKeys, or
+// returns "" when it is not defined.
+func (c *RcloneConf) SectionHash(name string) string {
+	section := c.Section(name)
+	if section == nil {
+		return ""
+	}
+
+	keys := make([]string, 0, len(section))
+	for key := range section {
+		if !slices.Contains(ManagedKeys, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s=%s\n", key, section[key])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// RemoteHashes maps the remote and everything it depends on to their section hashes.
+func (c *RcloneConf) RemoteHashes(name string) map[string]string {
+	hashes := make(map[string]string)
+	for _, remote := range c.Closure(name) {
+		hashes[remote] = c.SectionHash(remote)
+	}
+	return hashes
+}
+
+// ChangedRemotes lists the remotes whose section was added, removed or modified.
+func ChangedRemotes(old, new *RcloneConf) []string {
+	names := make(map[string]bool)
+	if old != nil {
+		for name := range old.Remotes {
+			names[name] = true
+		}
+	}
+	if new != nil {
+		for name := range new.Remotes {
+			names[name] = true
+		}
+	}
+
+	var changed []string
+	for name := range names {
+		if old.SectionHash(name) != new.SectionHash(name) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// TokenRefreshedRemotes lists the remotes where only ManagedKeys changed.
+func TokenRefreshedRemotes(old, new *RcloneConf) []string {
+	if old == nil || new == nil {
+		return nil
+	}
+
+	var refreshed []string
+	for name, newSection := range new.Remotes {
+		oldSection, ok := old.Remotes[name]
+		if !ok || maps.Equal(oldSection, newSection) {
+			continue
+		}
+		if old.SectionHash(name) == new.SectionHash(name) {
+			refreshed = append(refreshed, name)
+		}
+	}
+	sort.Strings(refreshed)
+	return refreshed
+}
+
+func remoteName(value string) string {
+	value = strings.TrimSpace(value)
+	// Local paths and on-the-fly backends (":s3,provider=...:bucket") are not remotes
+	if value == "" || strings.HasPrefix(value, ":") || strings.HasPrefix(value, "/") {
+		return ""
+	}
+	name, _, found := strings.Cut(value, ":")
+	if !found {
+		return ""
+	}
+	return name
+}
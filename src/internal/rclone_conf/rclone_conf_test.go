@@ -0,0 +1,136 @@
+package rclone_conf
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+const base = `[drive]
+type = drive
+scope = drive
+token = {"access_token":"a","expiry":"2026-01-01T00:00:00Z"}
+
+[secret]
+type = crypt
+remote = drive:encrypted
+password = p
+
+[s3]
+type = s3
+provider = AWS
+`
+
+func TestTokenRefreshIsNotAChange(t *testing.T) {
+	old := Parse([]byte(base))
+	refreshed := Parse([]byte(`[drive]
+type = drive
+scope = drive
+token = {"access_token":"b","expiry":"2026-01-01T01:00:00Z"}
+expiry = 2026-01-01T01:00:00Z
+
+[secret]
+type = crypt
+remote = drive:encrypted
+password = p
+
+[s3]
+type = s3
+provider = AWS
+`))
+
+	if changed := ChangedRemotes(old, refreshed); len(changed) != 0 {
+		t.Errorf("ChangedRemotes = %v, want none", changed)
+	}
+	if got := TokenRefreshedRemotes(old, refreshed); !slices.Equal(got, []string{"drive"}) {
+		t.Errorf("TokenRefreshedRemotes = %v, want [drive]", got)
+	}
+	// Units of the crypt remote on top keep their spec
+	if !maps.Equal(old.RemoteHashes("secret"), refreshed.RemoteHashes("secret")) {
+		t.Error("a token refresh changed the remote hashes of the crypt remote")
+	}
+}
+
+func TestKeyChangeIsAChange(t *testing.T) {
+	old := Parse([]byte(base))
+	edited := Parse([]byte(base + "region = eu-west-1\n"))
+
+	if got := ChangedRemotes(old, edited); !slices.Equal(got, []string{"s3"}) {
+		t.Errorf("ChangedRemotes = %v, want [s3]", got)
+	}
+	if got := TokenRefreshedRemotes(old, edited); len(got) != 0 {
+		t.Errorf("TokenRefreshedRemotes = %v, want none", got)
+	}
+}
+
+func TestAddedAndRemovedSections(t *testing.T) {
+	old := Parse([]byte(base))
+	edited := Parse([]byte(`[drive]
+type = drive
+scope = drive
+
+[secret]
+type = crypt
+remote = drive:encrypted
+password = p
+
+[b2]
+type = b2
+`))
+
+	// The token of drive is gone as well, which is no change of its own
+	if got := ChangedRemotes(old, edited); !slices.Equal(got, []string{"b2", "s3"}) {
+		t.Errorf("ChangedRemotes = %v, want [b2 s3]", got)
+	}
+	if got := ChangedRemotes(nil, old); !slices.Equal(got, []string{"drive", "s3", "secret"}) {
+		t.Errorf("ChangedRemotes from nothing = %v, want every remote", got)
+	}
+	if got := TokenRefreshedRemotes(nil, old); got != nil {
+		t.Errorf("TokenRefreshedRemotes from nothing = %v, want none", got)
+	}
+}
+
+func TestDependencyClosure(t *testing.T) {
+	old := Parse([]byte(base))
+	if got := old.Closure("secret"); !slices.Equal(got, []string{"drive", "secret"}) {
+		t.Fatalf("Closure(secret) = %v, want [drive secret]", got)
+	}
+
+	// Reconfiguring the base remote changes the crypt remote on top of it
+	edited := Parse([]byte(base + "\n[drive]\ntype = drive\nscope = drive.readonly\n"))
+	if got := ChangedRemotes(old, edited); !slices.Equal(got, []string{"drive"}) {
+		t.Errorf("ChangedRemotes = %v, want [drive]", got)
+	}
+	if maps.Equal(old.RemoteHashes("secret"), edited.RemoteHashes("secret")) {
+		t.Error("the remote hashes of the crypt remote did not change with its base")
+	}
+	if !maps.Equal(old.RemoteHashes("s3"), edited.RemoteHashes("s3")) {
+		t.Error("the remote hashes of an unrelated remote changed")
+	}
+
+	// Pointing the crypt remote at another base changes its closure
+	moved := Parse([]byte(base + "\n[secret]\ntype = crypt\nremote = s3:bucket\npassword = p\n"))
+	if got := moved.Closure("secret"); !slices.Equal(got, []string{"s3", "secret"}) {
+		t.Errorf("Closure(secret) = %v, want [s3 secret]", got)
+	}
+	if maps.Equal(old.RemoteHashes("secret"), moved.RemoteHashes("secret")) {
+		t.Error("the remote hashes of the crypt remote did not change with its base")
+	}
+}
+
+func TestDependenciesOfUnionAndCombine(t *testing.T) {
+	conf := Parse([]byte(`[union]
+type = union
+upstreams = drive:a s3:b:ro /local
+
+[combine]
+type = combine
+upstreams = one=drive: two=union:
+`))
+	if got := conf.Dependencies("union"); !slices.Equal(got, []string{"drive", "s3"}) {
+		t.Errorf("Dependencies(union) = %v, want [drive s3]", got)
+	}
+	if got := conf.Closure("combine"); !slices.Equal(got, []string{"combine", "drive", "s3", "union"}) {
+		t.Errorf("Closure(combine) = %v, want [combine drive s3 union]", got)
+	}
+}
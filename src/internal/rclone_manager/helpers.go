@@ -1,26 +1,126 @@
 package rclone_manager
 
 import (
+	"context"
+	"errors"
 	"github.com/rs/zerolog"
+	"path/filepath"
 	"rclone-manager/internal/config"
 	"rclone-manager/internal/constants"
 	"rclone-manager/internal/mount_manager"
-	"rclone-manager/internal/serve_manager"
+	"rclone-manager/internal/rclone_conf"
+	"slices"
 )
 
-func reloadConfig(file string, logger zerolog.Logger) {
+// reloadConfig applies the config after file changed. Stopping the units it
+// replaces gives up once ctx is done, leaving them to the shutdown.
+func (m *Manager) reloadConfig(ctx context.Context, file string, logger zerolog.Logger) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	isRcloneConf := filepath.Clean(file) == filepath.Clean(rclone_conf.Path())
+	remotes, err := loadRemotes()
+	var changedRemotes []string
+	switch {
+	case err != nil:
+		// Likely caught mid-write, comparing with nothing would restart every unit
+		logger.Warn().Err(err).Str(constants.LogFile, rclone_conf.Path()).
+			Msg("Failed to read rclone.conf, keeping the remotes last read")
+		if isRcloneConf {
+			return
+		}
+		remotes = m.remotes
+	case isRcloneConf:
+		changedRemotes = rclone_conf.ChangedRemotes(m.remotes, remotes)
+		if len(changedRemotes) == 0 {
+			if refreshed := rclone_conf.TokenRefreshedRemotes(m.remotes, remotes); len(refreshed) > 0 {
+				count := m.status.RecordTokenRefresh()
+				logger.Info().Strs(constants.LogRemotes, refreshed).Int64(constants.LogCount, count).
+					Msg("rclone refreshed OAuth tokens in rclone.conf, skipping reload")
+			} else {
+				logger.Info().Str(constants.LogFile, file).Msg("No remote sections changed in rclone.conf, nothing to do")
+			}
+			m.remotes = remotes
+			return
+		}
+		logger.Info().Strs(constants.LogRemotes, changedRemotes).
+			Msg("Remotes changed in rclone.conf, restarting dependent mounts and serves")
+	default:
+		changedRemotes = rclone_conf.ChangedRemotes(m.remotes, remotes)
+	}
+
 	logger.Info().Str(constants.LogFile, file).Msg("Reloading configuration...")
 
 	conf, err := config.LoadConfig()
 	if err != nil {
+		var validationErr *config.ValidationError
+		if errors.As(err, &validationErr) {
+			m.status.SetRejectedConfig(validationErr.Revision, validationErr.Messages())
+			logger.Error().Str(constants.LogRevision, validationErr.Revision).
+				Strs(constants.LogErrors, validationErr.Messages()).
+				Str(constants.LogKeptRevision, m.config.Revision).
+				Msg("Rejected invalid configuration, keeping the last known-good configuration")
+			return
+		}
 		logger.Error().Err(err).Msg("Failed to reload config")
 		return
 	}
 
-	mount_manager.ReconcileMounts(conf, logger, &processLock)
-	serve_manager.ReconcileServes(conf, logger, &processLock)
+	if conf.Mode != m.config.Mode {
+		logger.Warn().
+			Str(constants.LogMode, conf.Mode).
+			Msg("Changing mode requires a restart, ignoring reloaded configuration")
+		return
+	}
+
+	m.resetChangedBreakers(conf, remotes, changedRemotes)
+	mount_manager.CheckPropagation(conf, m.status, logger)
+
+	if conf.IsRcdMode() {
+		m.rcd.Reconcile(ctx, conf, remotes)
+	} else {
+		m.mounts.Reconcile(ctx, conf, remotes)
+		m.serves.Reconcile(ctx, conf, remotes)
+	}
+	// Units started by the reconcile are checked for readiness by the supervisor
+	m.wakeSupervisor()
 
-	LoadedConfig = conf
+	m.config = conf
+	m.shutdownTimeout.Store(int64(conf.ShutdownTimeout))
+	m.remotes = remotes
+	m.status.SetAppliedConfig(conf.Revision)
 
 	logger.Info().Msg("Configuration reloaded successfully")
 }
+
+// resetChangedBreakers gives backends whose rclone.conf section, or a remote
+// they depend on, was edited a fresh start, as the edit is likely the fix.
+func (m *Manager) resetChangedBreakers(conf *config.Config, remotes *rclone_conf.RcloneConf, changedRemotes []string) {
+	if len(changedRemotes) == 0 {
+		return
+	}
+
+	var backends []string
+	for _, mount := range conf.Mounts {
+		backends = append(backends, mount.BackendName)
+	}
+	for _, serve := range conf.Serves {
+		backends = append(backends, serve.BackendName)
+	}
+
+	for _, backend := range backends {
+		for _, remote := range remotes.Closure(backend) {
+			if slices.Contains(changedRemotes, remote) {
+				if m.breakers.Reset(backend) {
+					m.logger.Info().Str(constants.LogBackend, backend).
+						Msg("Remote changed in rclone.conf, circuit breaker reset")
+				}
+				break
+			}
+		}
+	}
+}
+
+func loadRemotes() (*rclone_conf.RcloneConf, error) {
+	return rclone_conf.Load(rclone_conf.Path())
+}
@@ -1,64 +1,188 @@
 package rclone_manager
 
 import (
+	"context"
+	"errors"
 	"github.com/rs/zerolog"
+	"os"
+	"rclone-manager/internal/circuit_breaker"
 	"rclone-manager/internal/config"
 	"rclone-manager/internal/constants"
 	"rclone-manager/internal/environment"
+	"rclone-manager/internal/instance_tracker"
 	"rclone-manager/internal/mount_manager"
+	"rclone-manager/internal/rcd_manager"
+	"rclone-manager/internal/rclone_conf"
 	"rclone-manager/internal/serve_manager"
+	"rclone-manager/internal/status"
 	"rclone-manager/internal/watcher"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var (
-	LoadedConfig *config.Config
-	processLock  sync.Mutex
-)
+// exitWaitTimeout bounds the wait for stopped processes to be reaped before
+// Run returns.
+const exitWaitTimeout = 5 * time.Second
+
+// Manager owns everything rclone manager runs. mu serializes the initial
+// setup, config reloads, the supervisor and shutdown, and guards every field
+// below it. The mount, serve and rcd managers and their supervisors are not
+// safe for concurrent use, they are only called with mu held. Readiness checks
+// run without it, only their results are recorded with it held.
+type Manager struct {
+	logger   zerolog.Logger
+	status   *status.Recorder
+	breakers *circuit_breaker.Breakers
+	wake     chan struct{}
+	// shutdownTimeout is that of the config applied last, read without mu as
+	// shutdown begins
+	shutdownTimeout atomic.Int64
 
-func InitializeRClone(logger zerolog.Logger) {
+	mu      sync.Mutex
+	config  *config.Config
+	remotes *rclone_conf.RcloneConf
+	mounts  *mount_manager.Manager
+	serves  *serve_manager.Manager
+	rcd     *rcd_manager.Manager
+}
 
+func NewManager(logger zerolog.Logger) *Manager {
+	recorder := status.NewRecorder(os.Getenv(constants.StatusFileEnvVar))
+	return &Manager{
+		logger:   logger,
+		status:   recorder,
+		breakers: circuit_breaker.NewBreakers(recorder),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Run starts every mount and serve in the config and supervises them until ctx
+// is done. It then stops them all within the shutdown timeout and returns once
+// every goroutine it started has finished.
+func (m *Manager) Run(ctx context.Context) error {
 	conf, err := config.LoadConfig()
 	if err != nil {
-
-		logger.Fatal().Err(err).Msg("Failed to load configuration")
+		var validationErr *config.ValidationError
+		if errors.As(err, &validationErr) {
+			m.status.SetRejectedConfig(validationErr.Revision, validationErr.Messages())
+			m.logger.Error().Str(constants.LogRevision, validationErr.Revision).
+				Strs(constants.LogErrors, validationErr.Messages()).
+				Msg("Configuration is invalid")
+		}
+		return err
 	}
 
+	mount_manager.CleanupOrphans(conf, m.logger)
+	mount_manager.CheckPropagation(conf, m.status, m.logger)
+
 	if len(conf.Serves) == 0 && len(conf.Mounts) == 0 {
-		logger.Warn().Msg("No serves or mounts found in configuration. Exiting...")
-		return
+		m.logger.Warn().Msg("No serves or mounts found in configuration. Nothing to do...")
+		<-ctx.Done()
+		return nil
 	}
 
-	processLock.Lock()
-	defer processLock.Unlock()
+	events := instance_tracker.NewExitEvents(ctx)
 
-	LoadedConfig = conf
-
-	if len(conf.Serves) > 0 {
-		go serve_manager.InitializeServeEndpoints(conf, logger, &processLock)
+	m.mu.Lock()
+	m.config = conf
+	m.shutdownTimeout.Store(int64(conf.ShutdownTimeout))
+	m.remotes, err = loadRemotes()
+	if err != nil {
+		m.logger.Warn().Err(err).Str(constants.LogFile, rclone_conf.Path()).
+			Msg("Failed to read rclone.conf, remote changes will not be detected until it can be read")
+		m.remotes = &rclone_conf.RcloneConf{}
 	}
+	m.mounts = mount_manager.NewManager(events, m.breakers, m.status, m.logger)
+	m.serves = serve_manager.NewManager(events, m.breakers, m.status, m.logger)
+	m.rcd = rcd_manager.NewManager(events, m.breakers, m.status, m.logger)
+	m.status.SetAppliedConfig(conf.Revision)
 
-	if len(conf.Mounts) > 0 {
-		go mount_manager.InitializeMountEndpoints(conf, logger, &processLock)
+	m.logger.Info().Str(constants.LogMode, conf.Mode).Msg("Starting rclone manager")
+
+	if conf.IsRcdMode() {
+		m.rcd.Initialize(ctx, conf, m.remotes)
+	} else {
+		m.serves.Initialize(ctx, conf, m.remotes)
+		m.mounts.Initialize(ctx, conf, m.remotes)
 	}
+	m.mu.Unlock()
 
-	yamlPath := environment.GetEnvWithFallback(constants.YAMLPathEnvVar, constants.DefaultYAMLPath)
-	rcloneConfPath := environment.GetEnvWithFallback(constants.RcloneConfEnvVar, constants.DefaultRcloneConf)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.supervise(ctx, events, conf.IsRcdMode())
+	}()
 
 	filesToWatch := []string{
-		yamlPath,
-		rcloneConfPath,
+		config.Path(),
+		rclone_conf.Path(),
 	}
 
-	watcher.StartNewFileWatcher(filesToWatch, reloadConfig, logger)
+	quietPeriod := environment.GetDurationEnvWithFallback(constants.WatchQuietPeriodEnvVar, constants.DefaultWatchQuietPeriod)
+	reload := func(file string, logger zerolog.Logger) {
+		m.reloadConfig(ctx, file, logger)
+	}
+	fileWatcher, err := watcher.StartNewFileWatcher(filesToWatch, quietPeriod, reload, m.logger)
+	if err != nil {
+		m.logger.Error().Err(err).Msg("Failed to start file watcher, configuration changes will not be picked up")
+	}
+
+	<-ctx.Done()
+	// The shutdown timeout starts now, a reload or check still running gives up
+	// on ctx rather than taking from it
+	timeout := time.Duration(m.shutdownTimeout.Load())
+	stopCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	m.logger.Warn().Msg("Shutting down...")
+
+	if fileWatcher != nil {
+		fileWatcher.Close()
+	}
+	wg.Wait()
+
+	m.stopAll(stopCtx, timeout)
+	if !events.Wait(exitWaitTimeout) {
+		m.logger.Warn().Msg("Some rclone processes were not reaped before exiting")
+	}
+	return nil
 }
 
-func StopRclone(logger zerolog.Logger) {
-	processLock.Lock()
-	defer processLock.Unlock()
+// stopAll stops every mount and serve, in parallel, no later than the
+// deadline of ctx, which is the shutdown timeout after shutdown began.
+func (m *Manager) stopAll(ctx context.Context, timeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.logger.Info().Dur(constants.LogTimeout, timeout).Msg("Stopping all mounts and serves")
 
-	if LoadedConfig != nil {
-		serve_manager.Cleanup(logger)
-		mount_manager.Cleanup(LoadedConfig, logger)
+	if m.config.IsRcdMode() {
+		m.rcd.Cleanup(ctx, m.config)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		m.serves.Cleanup(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		m.mounts.Cleanup(ctx, m.config)
+	}()
+	wg.Wait()
+}
+
+// ResetBreakers closes every open circuit breaker, so units held in the failed
+// state are restarted right away.
+func (m *Manager) ResetBreakers() {
+	backends := m.breakers.ResetAll()
+	if len(backends) == 0 {
+		m.logger.Info().Msg("No circuit breaker is open, nothing to reset")
+		return
 	}
+	m.logger.Info().Strs(constants.LogBackend, backends).Msg("Circuit breakers reset by operator")
+	m.wakeSupervisor()
 }
@@ -0,0 +1,377 @@
+package rclone_manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"net"
+	"os"
+	"path/filepath"
+	"rclone-manager/internal/constants"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeRclone is run in place of rclone. It records its pid and sleeps, or
+// exits right away when it serves the Broken remote. Serving the Stubborn
+// remote it ignores SIGTERM.
+const fakeRclone = `#!/bin/sh
+echo $$ >> %s
+case "$*" in
+  *Broken:*) exit 1 ;;
+  *Stubborn:*) trap '' TERM ;;
+esac
+exec sleep 60
+`
+
+// env points the manager at a config, rclone.conf and rclone binary in a temp
+// directory, and returns the config path and the file the fake rclone records
+// its pids in.
+func env(t *testing.T, yaml string) (string, string) {
+	dir := t.TempDir()
+	pids := filepath.Join(dir, "pids")
+	files := map[string]string{
+		"config.yaml": yaml,
+		"rclone.conf": "[A]\ntype = local\n[B]\ntype = local\n[Broken]\ntype = local\n[Stubborn]\ntype = local\n",
+		"rclone":      fmt.Sprintf(fakeRclone, pids),
+		"mountinfo":   "",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv(constants.YAMLPathEnvVar, filepath.Join(dir, "config.yaml"))
+	t.Setenv(constants.RcloneConfEnvVar, filepath.Join(dir, "rclone.conf"))
+	t.Setenv(constants.RcloneBinaryNameEnvVar, filepath.Join(dir, "rclone"))
+	t.Setenv(constants.MountinfoEnvVar, filepath.Join(dir, "mountinfo"))
+	t.Setenv(constants.WatchQuietPeriodEnvVar, "50ms")
+	return filepath.Join(dir, "config.yaml"), pids
+}
+
+// run runs m until the returned function is called, which fails the test
+// unless Run returns promptly.
+func run(t *testing.T, m *Manager) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Run(ctx)
+	}()
+
+	stopped := false
+	stop := func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Run returned %v", err)
+			}
+		case <-time.After(15 * time.Second):
+			t.Fatal("Run did not return after its context was cancelled")
+		}
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+// waitFor polls until cond holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func hasUnit(m *Manager, name string) func() bool {
+	return func() bool {
+		_, ok := m.status.Snapshot().Units[name]
+		return ok
+	}
+}
+
+// started returns the pids the fake rclone recorded.
+func started(t *testing.T, path string) []int {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	var pids []int
+	for _, line := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+func serve(name, backend, addr string) string {
+	return fmt.Sprintf(`
+  - name: %s
+    backendName: %s
+    protocol: webdav
+    addr: %s
+    probe:
+      type: tcp
+      startupTimeout: 1h
+`, name, backend, addr)
+}
+
+func TestRunStopsEverythingOnCancel(t *testing.T) {
+	_, pids := env(t, "shutdownTimeout: 5s\nserves:"+
+		serve("a", "A", "127.0.0.1:18081")+
+		serve("b", "B", "127.0.0.1:18082"))
+	m := NewManager(zerolog.Nop())
+	stop := run(t, m)
+
+	waitFor(t, "both serves to start", func() bool {
+		return len(started(t, pids)) == 2
+	})
+	stop()
+
+	for _, pid := range started(t, pids) {
+		if err := syscall.Kill(pid, 0); !errors.Is(err, syscall.ESRCH) {
+			t.Errorf("process %d is still running after Run returned", pid)
+		}
+	}
+	for _, name := range []string{"a", "b"} {
+		if hasUnit(m, name)() {
+			t.Errorf("%s is still listed in the status after Run returned", name)
+		}
+	}
+}
+
+// TestReloadDuringSupervision edits the config while the supervisor runs and
+// an operator resets the breakers, which the race detector checks.
+func TestReloadDuringSupervision(t *testing.T) {
+	path, _ := env(t, "serves:"+serve("a", "A", "127.0.0.1:18083"))
+	m := NewManager(zerolog.Nop())
+	stop := run(t, m)
+	waitFor(t, "a to start", hasUnit(m, "a"))
+
+	var wg sync.WaitGroup
+	resetting := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-resetting:
+				return
+			default:
+				m.ResetBreakers()
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+	}()
+
+	reload := func(yaml string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reload("serves:" + serve("a", "A", "127.0.0.1:18083") + serve("b", "B", "127.0.0.1:18084"))
+	waitFor(t, "b to start", hasUnit(m, "b"))
+
+	reload("serves:" + serve("b", "B", "127.0.0.1:18084"))
+	waitFor(t, "a to be removed", func() bool {
+		return !hasUnit(m, "a")()
+	})
+
+	close(resetting)
+	wg.Wait()
+	stop()
+}
+
+func TestResetBreakersRestartsFailedUnit(t *testing.T) {
+	_, pids := env(t, `
+restart:
+  initialBackoff: 10ms
+  maxBackoff: 10ms
+  jitter: 0
+  maxRestarts: 2
+  window: 1h
+  coolDown: 1h
+serves:`+serve("broken", "Broken", "127.0.0.1:18085"))
+	m := NewManager(zerolog.Nop())
+	run(t, m)
+
+	tripped := func() bool {
+		return m.status.Snapshot().Breakers["Broken"].State == constants.BreakerOpen
+	}
+	waitFor(t, "the breaker to trip", tripped)
+	before := len(started(t, pids))
+
+	// Resets race with the supervisor, which must pick up the closed breaker
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.ResetBreakers()
+		}()
+	}
+	wg.Wait()
+
+	waitFor(t, "the unit to be restarted", func() bool {
+		return len(started(t, pids)) > before
+	})
+	waitFor(t, "the breaker to trip again", tripped)
+}
+
+// TestUnreadableRcloneConfKeepsRemotes reloads config.yaml while rclone.conf
+// cannot be read, which must not restart the units already running.
+func TestUnreadableRcloneConfKeepsRemotes(t *testing.T) {
+	path, pids := env(t, "serves:"+serve("a", "A", "127.0.0.1:18086"))
+	m := NewManager(zerolog.Nop())
+	run(t, m)
+	waitFor(t, "a to start", func() bool {
+		return len(started(t, pids)) == 1
+	})
+
+	if err := os.Remove(os.Getenv(constants.RcloneConfEnvVar)); err != nil {
+		t.Fatal(err)
+	}
+	yaml := "serves:" + serve("a", "A", "127.0.0.1:18086") + serve("b", "B", "127.0.0.1:18087")
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "b to start", hasUnit(m, "b"))
+
+	time.Sleep(200 * time.Millisecond)
+	if n := len(started(t, pids)); n != 2 {
+		t.Errorf("%d processes were started, want 2 as a keeps running", n)
+	}
+}
+
+// TestSlowCheckDoesNotBlockReload probes a serve that accepts connections but
+// never answers, which must not hold up a reload while the probe waits.
+func TestSlowCheckDoesNotBlockReload(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:18088")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	hung := `
+  - name: a
+    backendName: A
+    protocol: webdav
+    addr: 127.0.0.1:18088
+    probe:
+      type: http
+      timeout: 1h
+      startupTimeout: 0s
+`
+	path, pids := env(t, "serves:"+hung)
+	m := NewManager(zerolog.Nop())
+	run(t, m)
+	waitFor(t, "a to start", func() bool {
+		return len(started(t, pids)) == 1
+	})
+	// Give the probe time to connect and hang
+	time.Sleep(1500 * time.Millisecond)
+
+	if err := os.WriteFile(path, []byte("serves:"+hung+serve("b", "B", "127.0.0.1:18089")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := time.Now()
+	waitFor(t, "b to start", hasUnit(m, "b"))
+	if took := time.Since(reloaded); took > 3*time.Second {
+		t.Errorf("the reload took %s while a probe hung", took)
+	}
+}
+
+// TestFailedCheckRestartsUnit never lets a serve pass its probe, so it is
+// stopped in the background and restarted once its process exited.
+func TestFailedCheckRestartsUnit(t *testing.T) {
+	_, pids := env(t, `
+restart:
+  initialBackoff: 10ms
+  maxBackoff: 10ms
+  jitter: 0
+serves:
+  - name: a
+    backendName: A
+    protocol: webdav
+    addr: 127.0.0.1:18090
+    probe:
+      type: tcp
+      startupTimeout: 500ms
+`)
+	m := NewManager(zerolog.Nop())
+	run(t, m)
+
+	waitFor(t, "a to be restarted", func() bool {
+		return len(started(t, pids)) >= 2
+	})
+	first := started(t, pids)[0]
+	if err := syscall.Kill(first, 0); !errors.Is(err, syscall.ESRCH) {
+		t.Errorf("process %d that failed its checks is still running", first)
+	}
+}
+
+// TestShutdownInterruptsReload stops a unit that ignores SIGTERM in a reload
+// and shuts down meanwhile, which must keep to the shutdown timeout rather
+// than wait for the stop timeout of the unit.
+func TestShutdownInterruptsReload(t *testing.T) {
+	stubborn := `
+  - name: a
+    backendName: Stubborn
+    protocol: webdav
+    addr: 127.0.0.1:18091
+    stopTimeout: 1h
+`
+	path, pids := env(t, "shutdownTimeout: 1s\nserves:"+stubborn)
+	stop := run(t, NewManager(zerolog.Nop()))
+	waitFor(t, "a to start", func() bool {
+		return len(started(t, pids)) == 1
+	})
+
+	if err := os.WriteFile(path, []byte("shutdownTimeout: 1s\nserves:"+serve("b", "B", "127.0.0.1:18092")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Give the reload time to start stopping a
+	time.Sleep(500 * time.Millisecond)
+
+	stopping := time.Now()
+	stop()
+	if took := time.Since(stopping); took > 5*time.Second {
+		t.Errorf("shutting down took %s, want about the shutdown timeout of 1s", took)
+	}
+	first := started(t, pids)[0]
+	if err := syscall.Kill(first, 0); !errors.Is(err, syscall.ESRCH) {
+		t.Errorf("process %d is still running after Run returned", first)
+	}
+}
@@ -0,0 +1,94 @@
+package rclone_manager
+
+import (
+	"context"
+	"rclone-manager/internal/constants"
+	"rclone-manager/internal/instance_tracker"
+	"rclone-manager/internal/supervisor"
+	"sync"
+	"time"
+)
+
+// supervise is the single loop that decides about restarts until ctx is done.
+// Exit events of every process arrive as they happen, and a timer fires when
+// the next scheduled restart is due.
+func (m *Manager) supervise(ctx context.Context, events *instance_tracker.ExitEvents, rcdMode bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			m.logger.Error().Msgf("Supervisor crashed: %v", r)
+		}
+	}()
+
+	m.logger.Info().Msg("Starting rclone process supervisor...")
+
+	// Checks run without mu, so a slow one holds up neither the others nor a
+	// reload, and report back on results
+	results := make(chan *supervisor.Check)
+	var checks sync.WaitGroup
+	defer checks.Wait()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	var resync <-chan time.Time
+	if rcdMode {
+		ticker := time.NewTicker(constants.RcdResyncInterval)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			m.logger.Info().Msg("Stopping rclone process supervisor")
+			return
+		case event := <-events.C():
+			m.mu.Lock()
+			handled := m.mounts.HandleExit(event) || m.serves.HandleExit(event) || m.rcd.HandleExit(event)
+			m.mu.Unlock()
+			if !handled {
+				m.logger.Debug().Str(constants.LogName, event.Name).Msg("Ignoring exit of a process that is no longer supervised")
+			}
+		case check := <-results:
+			m.mu.Lock()
+			check.Record()
+			m.mu.Unlock()
+		case <-resync:
+			m.mu.Lock()
+			m.rcd.Resync(ctx)
+			m.mu.Unlock()
+		case <-m.wake:
+		case <-timer.C:
+		}
+
+		m.mu.Lock()
+		mountChecks, next := m.mounts.Tick()
+		serveChecks, serveNext := m.serves.Tick()
+		rcdChecks, rcdNext := m.rcd.Tick(ctx)
+		m.mu.Unlock()
+
+		for _, check := range append(append(mountChecks, serveChecks...), rcdChecks...) {
+			checks.Add(1)
+			go func() {
+				defer checks.Done()
+				check.Run(ctx)
+				select {
+				case results <- check:
+				case <-ctx.Done():
+				}
+			}()
+		}
+
+		next = instance_tracker.Earliest(next, instance_tracker.Earliest(serveNext, rcdNext))
+		timer.Stop()
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+func (m *Manager) wakeSupervisor() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
@@ -1,72 +1,30 @@
 package serve_manager
 
 import (
-	"fmt"
-	"github.com/rs/zerolog"
-	"os"
-	"os/exec"
 	"rclone-manager/internal/config"
 	"rclone-manager/internal/constants"
-	"rclone-manager/internal/environment"
 	"rclone-manager/internal/instance_tracker"
+	"rclone-manager/internal/rclone_conf"
+	"rclone-manager/internal/spec"
+	"rclone-manager/internal/supervisor"
 )
 
-func createServeCommand(instance *ServeProcess) *exec.Cmd {
-	backendArg := fmt.Sprintf("%s:", instance.BackendName)
-	rcloneBin := environment.GetEnvWithFallback(constants.RcloneBinaryNameEnvVar, constants.DefaultRcloneBinaryName)
-	cmd := exec.Command(rcloneBin, constants.Serve, instance.Protocol, backendArg, constants.Addr, instance.Addr)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	cmd.Env = environment.PrepareEnvironment(instance.Environment)
-
-	return cmd
-}
-
-func setupServesFromConfig(conf *config.Config, logger zerolog.Logger) {
+func units(conf *config.Config, remotes *rclone_conf.RcloneConf) []supervisor.Unit {
+	units := make([]supervisor.Unit, 0, len(conf.Serves))
 	for _, serve := range conf.Serves {
-		instance := &ServeProcess{
+		units = append(units, &ServeProcess{
 			Protocol: serve.Protocol,
 			Addr:     serve.Addr,
+			Probe:    serve.Probe,
 			RcloneProcess: instance_tracker.RcloneProcess{
+				Name:        serve.Name,
 				BackendName: serve.BackendName,
 				Environment: serve.Environment,
+				Spec:        spec.ForServe(constants.ModeProcess, serve, remotes),
+				Restart:     serve.Restart,
+				StopTimeout: serve.StopTimeout,
 			},
-		}
-		if existing, ok := tracker.Get(serve.BackendName); ok {
-			if existing.Protocol != serve.Protocol || existing.Addr != serve.Addr {
-				logger.Warn().
-					Str(constants.LogBackend, serve.BackendName).
-					Msg("Serve config changed, restarting...")
-				StopServe(existing, logger)
-				StartServeWithRetries(instance, logger)
-			}
-		} else {
-			logger.Info().
-				Str(constants.LogBackend, serve.BackendName).
-				Msg("New serve detected, starting...")
-			StartServeWithRetries(instance, logger)
-		}
-	}
-}
-
-func removeStaleServes(conf *config.Config, logger zerolog.Logger) {
-	var staleKeys []interface{}
-
-	tracker.Range(func(key, value interface{}) bool {
-		instance := value.(*ServeProcess)
-		if !config.IsServeInConfig(instance.BackendName, conf) {
-			logger.Warn().
-				Str(constants.LogBackend, instance.BackendName).
-				Msg("Serve removed from config, stopping...")
-			staleKeys = append(staleKeys, key)
-		}
-		return true
-	})
-
-	for _, key := range staleKeys {
-		if instance, ok := tracker.Get(key.(string)); ok {
-			StopServe(instance, logger)
-		}
+		})
 	}
+	return units
 }
@@ -0,0 +1,97 @@
+package serve_manager
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"rclone-manager/internal/config"
+	"slices"
+	"strings"
+)
+
+func probeTCP(ctx context.Context, addr string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", probeAddr(addr))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeHTTP requests the probe path and checks the status, which catches a
+// handler that accepts connections but no longer answers.
+func probeHTTP(ctx context.Context, probe config.ProbeConfig, addr string, secure bool) error {
+	scheme := "http"
+	transport := &http.Transport{DisableKeepAlives: true}
+	if secure {
+		scheme = "https"
+		// The probe only checks the serve answers, not who it claims to be
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s%s", scheme, probeAddr(addr), probe.Path), nil)
+	if err != nil {
+		return err
+	}
+	response, err := (&http.Client{Transport: transport}).Do(request)
+	if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+
+	if len(probe.ExpectStatus) == 0 {
+		if response.StatusCode >= 500 {
+			return fmt.Errorf("GET %s returned %s", probe.Path, response.Status)
+		}
+		return nil
+	}
+	if !slices.Contains(probe.ExpectStatus, response.StatusCode) {
+		return fmt.Errorf("GET %s returned %s, expected one of %v", probe.Path, response.Status, probe.ExpectStatus)
+	}
+	return nil
+}
+
+// probeSSH waits for the SSH identification string the server sends first.
+func probeSSH(ctx context.Context, addr string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", probeAddr(addr))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetReadDeadline(deadline)
+	}
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("no SSH banner: %w", err)
+	}
+	if !strings.HasPrefix(banner, "SSH-") {
+		return fmt.Errorf("unexpected SSH banner %q", strings.TrimSpace(banner))
+	}
+	return nil
+}
+
+// probeAddr connects to the loopback address when the serve listens on every
+// interface.
+func probeAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// usesTLS reports whether the serve was given a certificate and speaks HTTPS.
+func usesTLS(args []string) bool {
+	return slices.ContainsFunc(args, func(arg string) bool {
+		return strings.HasPrefix(arg, "-") && config.FlagName(arg) == "cert"
+	})
+}
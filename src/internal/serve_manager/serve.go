@@ -1,101 +1,109 @@
 package serve_manager
 
 import (
+	"context"
 	"github.com/rs/zerolog"
+	"os/exec"
+	"rclone-manager/internal/circuit_breaker"
 	"rclone-manager/internal/config"
 	"rclone-manager/internal/constants"
 	"rclone-manager/internal/instance_tracker"
-	"sync"
-	"time"
+	"rclone-manager/internal/rclone_conf"
+	"rclone-manager/internal/status"
+	"rclone-manager/internal/supervisor"
 )
 
+// ServeProcess is the supervisor unit of a serve, run as its own rclone serve
+// process.
 type ServeProcess struct {
 	instance_tracker.RcloneProcess
 	Protocol string
 	Addr     string
+	Probe    config.ProbeConfig
 }
 
-var tracker instance_tracker.InstanceTracker[ServeProcess]
+func (p *ServeProcess) Process() *instance_tracker.RcloneProcess {
+	return &p.RcloneProcess
+}
 
-func InitializeServeEndpoints(conf *config.Config, logger zerolog.Logger, processLock *sync.Mutex) {
-	processLock.Lock()
-	defer processLock.Unlock()
+func (p *ServeProcess) Command() *exec.Cmd {
+	return supervisor.NewCommand(p.Spec)
+}
 
-	if len(conf.Serves) == 0 {
-		logger.Debug().Msg("No rclone serve endpoints defined... Skipping starting any")
-		return
-	}
+func (p *ServeProcess) PreStart() error {
+	return nil
+}
 
-	logger.Info().Msg("Initializing all serve endpoints")
-	setupServesFromConfig(conf, logger)
+func (p *ServeProcess) PreStop(ctx context.Context) error {
+	return nil
+}
 
-	go MonitorServeProcesses(logger)
+func (p *ServeProcess) PostStop() {}
+
+func (p *ServeProcess) Refresh(desired supervisor.Unit) {
+	serve := desired.(*ServeProcess)
+	p.Restart = serve.Restart
+	p.StopTimeout = serve.StopTimeout
+	p.Probe = serve.Probe
 }
 
-func StartServeWithRetries(instance *ServeProcess, logger zerolog.Logger) *ServeProcess {
-	retries := 0
-	for retries < 3 {
-		cmd := createServeCommand(instance)
-		instance.Command = cmd
-		err := cmd.Start()
-		if err == nil {
-			logger.Info().
-				Str(constants.LogBackend, instance.BackendName).
-				Str(constants.LogProtocol, instance.Protocol).
-				Str(constants.LogAddr, instance.Addr).
-				Msg("Serve started successfully.")
-			instance.PID = cmd.Process.Pid
-			instance.StartedAt = time.Now()
-			instance.GracePeriod = 10 * time.Second
-			tracker.Track(instance.BackendName, instance)
-			go func() {
-				err := cmd.Wait()
-				if err != nil {
-					logger.Warn().AnErr(constants.LogError, err).
-						Str(constants.LogBackend, instance.BackendName).
-						Msg("Serve process exited with error.")
-				} else {
-					logger.Info().
-						Str(constants.LogBackend, instance.BackendName).
-						Msg("Serve process exited normally.")
-				}
-			}()
-			return instance
-		}
-		logger.Warn().AnErr(constants.LogError, err).Msgf("Serve failed. Retrying %d/3...", retries+1)
-		retries++
-		time.Sleep(5 * time.Second)
+// Checks runs the probe of the serve against its addr.
+func (p *ServeProcess) Checks() supervisor.Checks {
+	probe, addr, tls := p.Probe, p.Addr, usesTLS(p.Spec.Args)
+	return supervisor.Checks{
+		Ready: func(ctx context.Context) error {
+			switch probe.Type {
+			case constants.ProbeHTTP:
+				return probeHTTP(ctx, probe, addr, tls)
+			case constants.ProbeSSH:
+				return probeSSH(ctx, addr)
+			default:
+				return probeTCP(ctx, addr)
+			}
+		},
+		InitialDelay:     p.Probe.InitialDelay,
+		Period:           p.Probe.Period,
+		Timeout:          p.Probe.Timeout,
+		FailureThreshold: p.Probe.FailureThreshold,
+		StartupTimeout:   p.Probe.StartupTimeout,
 	}
-	logger.Error().Str(constants.LogBackend, instance.BackendName).Msg("Failed to start serve after 3 attempts.")
-	return nil
 }
 
-func StopServe(instance *ServeProcess, logger zerolog.Logger) {
-	logger.Info().Str(constants.LogBackend, instance.BackendName).Msg("Stopping serve process...")
-	if err := instance.Command.Process.Kill(); err == nil {
-		tracker.Untrack(instance.BackendName)
-		logger.Info().Int(constants.LogPid, instance.PID).Str(constants.LogBackend, instance.BackendName).Msg("Serve process stopped")
-	} else {
-		logger.Warn().AnErr(constants.LogError, err).Int(constants.LogPid, instance.PID).Str(constants.LogBackend, instance.BackendName).Msg("Failed to stop serve process")
-	}
+func (p *ServeProcess) MarshalZerologObject(e *zerolog.Event) {
+	e.Str(constants.LogProtocol, p.Protocol).Str(constants.LogAddr, p.Addr)
 }
 
-func Cleanup(logger zerolog.Logger) {
-	shouldMonitorProcesses = false
-	logger.Info().Msg("Cleaning up all rclone serve processes")
-	tracker.Range(func(key, value interface{}) bool {
-		instance := value.(*ServeProcess)
-		StopServe(instance, logger)
-		return true
-	})
+// Manager runs every serve on a supervisor.
+type Manager struct {
+	*supervisor.Supervisor
+	logger zerolog.Logger
 }
 
-func ReconcileServes(conf *config.Config, logger zerolog.Logger, processLock *sync.Mutex) {
-	processLock.Lock()
-	defer processLock.Unlock()
+func NewManager(events *instance_tracker.ExitEvents, breakers *circuit_breaker.Breakers, recorder *status.Recorder, logger zerolog.Logger) *Manager {
+	return &Manager{
+		Supervisor: supervisor.New(constants.Serve, events, breakers, recorder, logger),
+		logger:     logger,
+	}
+}
+
+func (m *Manager) Initialize(ctx context.Context, conf *config.Config, remotes *rclone_conf.RcloneConf) {
+	if len(conf.Serves) == 0 {
+		m.logger.Debug().Msg("No rclone serve endpoints defined... Skipping starting any")
+		return
+	}
+
+	m.logger.Info().Msg("Initializing all serve endpoints")
+	m.Apply(ctx, units(conf, remotes))
+}
 
-	logger.Info().Msg("Reconciling serves...")
+// Cleanup stops every serve in parallel, each within its stop timeout but no
+// later than the deadline of ctx.
+func (m *Manager) Cleanup(ctx context.Context) {
+	m.logger.Info().Msg("Cleaning up all rclone serve processes")
+	m.StopAll(ctx)
+}
 
-	setupServesFromConfig(conf, logger)
-	removeStaleServes(conf, logger)
+func (m *Manager) Reconcile(ctx context.Context, conf *config.Config, remotes *rclone_conf.RcloneConf) {
+	m.logger.Info().Msg("Reconciling serves...")
+	m.Apply(ctx, units(conf, remotes))
 }
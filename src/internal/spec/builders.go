@@ -0,0 +1,58 @@
+package spec
+
+import (
+	"rclone-manager/internal/config"
+	"rclone-manager/internal/constants"
+	"rclone-manager/internal/environment"
+	"rclone-manager/internal/rclone_conf"
+)
+
+// ForMount builds the spec a mount runs with in the given mode. In rcd mode
+// the args describe the RC call instead of a command line, and per-unit
+// environment, args and flags are not applied.
+func ForMount(mode string, mount config.Mount, remotes *rclone_conf.RcloneConf) *Spec {
+	if mode == constants.ModeRcd {
+		return &Spec{
+			Args:    []string{"mount/mount", mount.Source(), mount.MountPoint},
+			Remotes: remotes.RemoteHashes(mount.BackendName),
+		}
+	}
+
+	base := []string{constants.Mount, mount.Source(), mount.MountPoint}
+	if mount.AllowNonEmpty {
+		// rclone refuses a non-empty mount point on its own as well
+		base = append(base, constants.AllowNonEmpty)
+	}
+	return &Spec{
+		Binary:      rcloneBinary(),
+		Args:        extendArgs(base, mount.Args, mount.Flags),
+		Environment: mount.Environment,
+		Remotes:     remotes.RemoteHashes(mount.BackendName),
+	}
+}
+
+func ForServe(mode string, serve config.Serve, remotes *rclone_conf.RcloneConf) *Spec {
+	if mode == constants.ModeRcd {
+		return &Spec{
+			Args:    []string{"serve/start", serve.Protocol, serve.Source(), serve.Addr},
+			Remotes: remotes.RemoteHashes(serve.BackendName),
+		}
+	}
+
+	return &Spec{
+		Binary:      rcloneBinary(),
+		Args:        extendArgs([]string{constants.Serve, serve.Protocol, serve.Source(), constants.Addr, serve.Addr}, serve.Args, serve.Flags),
+		Environment: serve.Environment,
+		Remotes:     remotes.RemoteHashes(serve.BackendName),
+	}
+}
+
+func extendArgs(base []string, args []string, flags config.Flags) []string {
+	result := append([]string{}, base...)
+	result = append(result, args...)
+	return append(result, flags.Args()...)
+}
+
+func rcloneBinary() string {
+	return environment.GetEnvWithFallback(constants.RcloneBinaryNameEnvVar, constants.DefaultRcloneBinaryName)
+}
@@ -0,0 +1,36 @@
+package spec
+
+import (
+	"rclone-manager/internal/constants"
+	"strconv"
+	"strings"
+)
+
+// RcAddr returns the address of the remote control API a process mode unit
+// serves, when its args or environment enable it with --rc / RCLONE_RC.
+func (s *Spec) RcAddr() (string, bool) {
+	enabled, _ := strconv.ParseBool(s.Environment["RCLONE_RC"])
+	addr := s.Environment["RCLONE_RC_ADDR"]
+
+	for i, arg := range s.Args {
+		name, value, hasValue := strings.Cut(arg, "=")
+		switch name {
+		case "--rc":
+			enabled = !hasValue || value == "true"
+		case constants.RcAddr:
+			if hasValue {
+				addr = value
+			} else if i+1 < len(s.Args) {
+				addr = s.Args[i+1]
+			}
+		}
+	}
+
+	if !enabled {
+		return "", false
+	}
+	if addr == "" {
+		addr = constants.DefaultRcAddr
+	}
+	return addr, true
+}
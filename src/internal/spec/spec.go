@@ -0,0 +1,139 @@
+package spec
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Spec is everything that determines how a unit is run. Two units with the
+// same fingerprint would run identically, so a changed fingerprint means restart.
+type Spec struct {
+	Binary      string            `json:"binary"`
+	Args        []string          `json:"args"`
+	Environment map[string]string `json:"environment,omitempty"`
+	Remotes     map[string]string `json:"remotes,omitempty"`
+}
+
+func (s *Spec) Fingerprint() string {
+	// encoding/json sorts map keys, which keeps the encoding canonical
+	data, _ := json.Marshal(s)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func Diff(old, new *Spec) []string {
+	var changes []string
+
+	if old.Binary != new.Binary {
+		changes = append(changes, fmt.Sprintf("binary: %s -> %s", old.Binary, new.Binary))
+	}
+
+	if !slices.Equal(old.Args, new.Args) {
+		changes = append(changes, fmt.Sprintf("args: [%s] -> [%s]", strings.Join(RedactArgs(old.Args), " "), strings.Join(RedactArgs(new.Args), " ")))
+	}
+
+	for _, key := range unionKeys(old.Environment, new.Environment) {
+		oldValue, hadOld := old.Environment[key]
+		newValue, hasNew := new.Environment[key]
+		switch {
+		case !hadOld:
+			changes = append(changes, fmt.Sprintf("environment %s added: %s", key, RedactEnv(key, newValue)))
+		case !hasNew:
+			changes = append(changes, fmt.Sprintf("environment %s removed", key))
+		case oldValue != newValue:
+			changes = append(changes, fmt.Sprintf("environment %s: %s -> %s", key, RedactEnv(key, oldValue), RedactEnv(key, newValue)))
+		}
+	}
+
+	// Remotes holds section hashes, rclone.conf values are often credentials anyway
+	for _, remote := range unionKeys(old.Remotes, new.Remotes) {
+		oldHash, hadOld := old.Remotes[remote]
+		newHash, hasNew := new.Remotes[remote]
+		switch {
+		case !hadOld:
+			changes = append(changes, fmt.Sprintf("rclone.conf remote [%s] now used", remote))
+		case !hasNew:
+			changes = append(changes, fmt.Sprintf("rclone.conf remote [%s] no longer used", remote))
+		case oldHash != newHash:
+			changes = append(changes, fmt.Sprintf("rclone.conf remote [%s] changed", remote))
+		}
+	}
+
+	return changes
+}
+
+func unionKeys(a, b map[string]string) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for key := range a {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for key := range b {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RedactEnv hides the value of environment variables that look like credentials.
+func RedactEnv(key, value string) string {
+	if isSecret(key) {
+		return redacted
+	}
+	return value
+}
+
+// RedactArgs hides the values of flags that look like credentials, both in
+// the --pass=value and the --pass value forms.
+func RedactArgs(args []string) []string {
+	result := make([]string, len(args))
+	redactNext := false
+	for i, arg := range args {
+		switch {
+		case redactNext && !strings.HasPrefix(arg, "-"):
+			result[i] = redacted
+			redactNext = false
+		case strings.HasPrefix(arg, "-") && isSecret(strings.SplitN(arg, "=", 2)[0]):
+			name, _, hasValue := strings.Cut(arg, "=")
+			if hasValue {
+				result[i] = name + "=" + redacted
+			} else {
+				result[i] = arg
+				redactNext = true
+			}
+		default:
+			result[i] = arg
+			redactNext = false
+		}
+	}
+	return result
+}
+
+const redacted = "<redacted>"
+
+var secretWords = []string{"PASS", "PASSWORD", "TOKEN", "SECRET", "KEY"}
+
+// isSecret looks at whole words of a flag or variable name, so RCLONE_CONFIG_X_PASS
+// and --s3-secret-access-key are secrets but --htpasswd is not.
+func isSecret(name string) bool {
+	words := strings.FieldsFunc(strings.ToUpper(name), func(r rune) bool {
+		return r == '-' || r == '_' || r == '='
+	})
+	for _, word := range words {
+		if slices.Contains(secretWords, word) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,241 @@
+package status
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type RejectedConfig struct {
+	Revision   string    `json:"revision"`
+	Errors     []string  `json:"errors"`
+	RejectedAt time.Time `json:"rejectedAt"`
+}
+
+type Breaker struct {
+	State     string    `json:"state"`
+	Restarts  int       `json:"restarts"`
+	TrippedAt time.Time `json:"trippedAt"`
+	OpenUntil time.Time `json:"openUntil"`
+}
+
+type Unit struct {
+	Kind           string    `json:"kind"`
+	State          string    `json:"state"`
+	Since          time.Time `json:"since"`
+	CheckLatencyMs float64   `json:"checkLatencyMs"`
+	CheckedAt      time.Time `json:"checkedAt"`
+}
+
+// Propagation is the propagation type of the filesystem a mount point is on.
+// Only mounts made on a shared one are visible outside the container.
+type Propagation struct {
+	Type       string    `json:"type"`
+	Filesystem string    `json:"filesystem"`
+	CheckedAt  time.Time `json:"checkedAt"`
+}
+
+type Status struct {
+	ConfigRevision  string                 `json:"configRevision"`
+	ConfigAppliedAt time.Time              `json:"configAppliedAt"`
+	RejectedConfig  *RejectedConfig        `json:"rejectedConfig,omitempty"`
+	TokenRefreshes  int64                  `json:"tokenRefreshes"`
+	Breakers        map[string]Breaker     `json:"breakers,omitempty"`
+	Units           map[string]Unit        `json:"units,omitempty"`
+	Propagation     map[string]Propagation `json:"propagation,omitempty"`
+}
+
+// latencyFlushInterval throttles rewrites of the file for check latencies
+// alone, which change with nearly every check.
+const latencyFlushInterval = 30 * time.Second
+
+// Recorder keeps the status of a running manager and publishes it as JSON to
+// path, when that is set, on every change.
+type Recorder struct {
+	path string
+
+	mu      sync.Mutex
+	current Status
+	written time.Time
+}
+
+func NewRecorder(path string) *Recorder {
+	return &Recorder{path: path}
+}
+
+func (r *Recorder) SetAppliedConfig(revision string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.current.ConfigRevision = revision
+	r.current.ConfigAppliedAt = time.Now()
+	r.current.RejectedConfig = nil
+	r.writeLocked()
+}
+
+func (r *Recorder) SetRejectedConfig(revision string, errors []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.current.RejectedConfig = &RejectedConfig{
+		Revision:   revision,
+		Errors:     errors,
+		RejectedAt: time.Now(),
+	}
+	r.writeLocked()
+}
+
+func (r *Recorder) RecordTokenRefresh() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.current.TokenRefreshes++
+	r.writeLocked()
+	return r.current.TokenRefreshes
+}
+
+// SetBreaker records the circuit breaker of a backend, nil removes it once it
+// is closed again.
+func (r *Recorder) SetBreaker(backend string, breaker *Breaker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if breaker == nil {
+		if _, ok := r.current.Breakers[backend]; !ok {
+			return
+		}
+		delete(r.current.Breakers, backend)
+	} else {
+		if r.current.Breakers == nil {
+			r.current.Breakers = make(map[string]Breaker)
+		}
+		r.current.Breakers[backend] = *breaker
+	}
+	r.writeLocked()
+}
+
+// SetUnit records the state of a supervised unit. The file is only rewritten
+// when the state changed, so it can be called after every check.
+func (r *Recorder) SetUnit(name, kind, state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.current.Units[name]
+	if ok && existing.Kind == kind && existing.State == state {
+		return
+	}
+	if r.current.Units == nil {
+		r.current.Units = make(map[string]Unit)
+	}
+	r.current.Units[name] = Unit{
+		Kind:           kind,
+		State:          state,
+		Since:          time.Now(),
+		CheckLatencyMs: existing.CheckLatencyMs,
+		CheckedAt:      existing.CheckedAt,
+	}
+	r.writeLocked()
+}
+
+// SetCheckLatency records how long the last readiness check of a unit took,
+// to show a unit slowing down before it fails. It reaches the file with the
+// next change, or once latencyFlushInterval passed since the last write.
+func (r *Recorder) SetCheckLatency(name string, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	unit, ok := r.current.Units[name]
+	if !ok {
+		return
+	}
+	unit.CheckLatencyMs = float64(latency.Microseconds()) / 1000
+	unit.CheckedAt = time.Now()
+	r.current.Units[name] = unit
+	if time.Since(r.written) >= latencyFlushInterval {
+		r.writeLocked()
+	}
+}
+
+func (r *Recorder) RemoveUnit(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.current.Units[name]; !ok {
+		return
+	}
+	delete(r.current.Units, name)
+	r.writeLocked()
+}
+
+// SetPropagation replaces the propagation of every checked mount point.
+func (r *Recorder) SetPropagation(propagation map[string]Propagation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(propagation) == 0 && len(r.current.Propagation) == 0 {
+		return
+	}
+	r.current.Propagation = propagation
+	r.writeLocked()
+}
+
+func (r *Recorder) Snapshot() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snapshot := r.current
+	if r.current.RejectedConfig != nil {
+		rejected := *r.current.RejectedConfig
+		snapshot.RejectedConfig = &rejected
+	}
+	if r.current.Breakers != nil {
+		snapshot.Breakers = make(map[string]Breaker, len(r.current.Breakers))
+		for backend, breaker := range r.current.Breakers {
+			snapshot.Breakers[backend] = breaker
+		}
+	}
+	if r.current.Units != nil {
+		snapshot.Units = make(map[string]Unit, len(r.current.Units))
+		for name, unit := range r.current.Units {
+			snapshot.Units[name] = unit
+		}
+	}
+	if r.current.Propagation != nil {
+		snapshot.Propagation = make(map[string]Propagation, len(r.current.Propagation))
+		for mountPoint, propagation := range r.current.Propagation {
+			snapshot.Propagation[mountPoint] = propagation
+		}
+	}
+	return snapshot
+}
+
+// writeLocked publishes the status as JSON when a path is set. The file is
+// replaced atomically so readers never see a partial write.
+func (r *Recorder) writeLocked() {
+	if r.path == "" {
+		return
+	}
+	r.written = time.Now()
+
+	data, err := json.MarshalIndent(r.current, "", "  ")
+	if err != nil {
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), ".status-*.json")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		return
+	}
+	_ = os.Rename(tmp.Name(), r.path)
+}
@@ -0,0 +1,199 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"rclone-manager/internal/constants"
+	"rclone-manager/internal/instance_tracker"
+	"time"
+)
+
+// HandleExit runs the post-stop hook of the unit the exit event is about and
+// schedules its restart. It reports false when the event is not about a unit
+// process that is still tracked, e.g. one that was stopped on purpose.
+func (s *Supervisor) HandleExit(event instance_tracker.ExitEvent) bool {
+	e, ok := s.units[event.Name]
+	if !ok || !e.unit.Process().Matches(event) {
+		return false
+	}
+	p := e.unit.Process()
+	if e.failure != nil {
+		// The exit caused by stopping a failed unit is not a crash of its own,
+		// and a late exit after the one reported for a process never reaped
+		// is not either
+		event.Err = e.failure
+		event.ExitCode = -1
+		event.Signal = ""
+		p.Command = nil
+	}
+	e.unit.PostStop()
+	p.HandleExit(event, time.Now(), s.logger)
+	s.publish(e.unit)
+	return true
+}
+
+// Check is a readiness check of a unit that is due. Tick hands it out so it
+// can run without the lock the supervisor is called with, Record takes its
+// result back with the lock held again.
+type Check struct {
+	supervisor *Supervisor
+	entry      *entry
+	checks     Checks
+	err        error
+	latency    time.Duration
+}
+
+// Run runs the check within its timeout, or until ctx is done.
+func (c *Check) Run(ctx context.Context) {
+	started := time.Now()
+	c.err = ready(ctx, c.checks)
+	c.latency = time.Since(started)
+}
+
+// Record moves the unit between the starting, ready and degraded states by
+// the result of the check, unless it was restarted or stopped in the meantime.
+func (c *Check) Record() {
+	c.supervisor.record(c)
+}
+
+// Tick restarts every unit whose backoff has passed and returns the readiness
+// checks that are due, and when it has to run again, the zero time if nothing
+// is scheduled. A unit is not checked again before its last check is recorded.
+func (s *Supervisor) Tick() ([]*Check, time.Time) {
+	now := time.Now()
+	var next time.Time
+	var checks []*Check
+
+	for _, e := range s.units {
+		p := e.unit.Process()
+		switch p.State {
+		case constants.StateStarting, constants.StateReady, constants.StateDegraded:
+			// A start that failed is reported as an exit, there is nothing to check
+			if p.PID == 0 || e.checking {
+				continue
+			}
+			if now.Before(e.nextCheck) {
+				next = instance_tracker.Earliest(next, e.nextCheck)
+				continue
+			}
+			e.checking = true
+			checks = append(checks, &Check{supervisor: s, entry: e, checks: e.checks})
+		case constants.StateStopping:
+			// A unit that failed its checks is waited for to exit
+		default:
+			wake, due := p.Due(now, s.breakers, s.logger)
+			s.publish(e.unit)
+			if !due {
+				next = instance_tracker.Earliest(next, wake)
+				continue
+			}
+			_ = s.Start(e.unit)
+			next = instance_tracker.Earliest(next, s.units[p.Name].nextCheck)
+		}
+	}
+	return checks, next
+}
+
+// record applies the result of a check to its unit. A unit that was restarted
+// meanwhile is tracked by a new entry, one that exited is no longer running.
+func (s *Supervisor) record(c *Check) {
+	e := c.entry
+	p := e.unit.Process()
+	if s.units[p.Name] != e {
+		return
+	}
+	e.checking = false
+	switch p.State {
+	case constants.StateStarting, constants.StateReady, constants.StateDegraded:
+	default:
+		return
+	}
+
+	err, latency := c.err, c.latency
+	s.status.SetCheckLatency(p.Name, latency)
+	if latency >= constants.SlowCheckThreshold {
+		s.logger.Warn().Str(constants.LogName, p.Name).
+			Dur(constants.LogLatency, latency).
+			EmbedObject(e.unit).
+			Msg("Readiness check of unit is slow")
+	}
+
+	starting := p.State == constants.StateStarting
+	if err == nil {
+		e.failures = 0
+	} else if !starting {
+		e.failures++
+	}
+
+	switch {
+	case errors.Is(err, ErrLost) && !starting:
+		s.fail(e, err)
+		return
+	case err != nil && starting && e.checks.StartupTimeout > 0 && time.Since(p.StartedAt) >= e.checks.StartupTimeout:
+		s.fail(e, fmt.Errorf("not ready within the startup timeout of %s, last: %w", e.checks.StartupTimeout, err))
+		return
+	case err != nil && e.checks.FailureThreshold > 0 && e.failures >= e.checks.FailureThreshold:
+		s.fail(e, fmt.Errorf("%d checks in a row failed, last: %w", e.failures, err))
+		return
+	case err == nil && p.State != constants.StateReady:
+		s.logger.Info().Str(constants.LogName, p.Name).
+			Str(constants.LogState, p.State).
+			EmbedObject(e.unit).
+			Msg("Unit is ready")
+		s.setState(e.unit, constants.StateReady)
+	case err != nil && p.State == constants.StateReady:
+		s.logger.Warn().AnErr(constants.LogError, err).
+			Str(constants.LogName, p.Name).
+			Int(constants.LogFailures, e.failures).
+			EmbedObject(e.unit).
+			Msg("Unit is no longer ready, it is degraded")
+		s.setState(e.unit, constants.StateDegraded)
+	case err != nil:
+		s.logger.Debug().AnErr(constants.LogError, err).
+			Str(constants.LogName, p.Name).
+			Str(constants.LogState, p.State).
+			Int(constants.LogFailures, e.failures).
+			Msg("Unit is not ready")
+	}
+
+	interval := e.checks.Period
+	if p.State == constants.StateStarting {
+		interval = min(constants.StartupCheckInterval, interval)
+	}
+	e.nextCheck = time.Now().Add(interval)
+}
+
+// ready bounds the readiness check by its timeout and ctx, even when the check
+// itself does not honor its context, e.g. a stat on a hung mount.
+func ready(ctx context.Context, checks Checks) error {
+	ctx, cancel := context.WithTimeout(ctx, checks.Timeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- checks.Ready(ctx)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fail stops a unit that lost what it provided or never became ready. The
+// process is stopped in the background, its exit then schedules the restart
+// of the unit as if it had crashed.
+func (s *Supervisor) fail(e *entry, err error) {
+	p := e.unit.Process()
+	s.logger.Warn().AnErr(constants.LogError, err).
+		Str(constants.LogName, p.Name).
+		EmbedObject(e.unit).
+		Msg("Unit failed its checks while its process is running, restarting")
+
+	e.failure = err
+	s.setState(e.unit, constants.StateStopping)
+	p.Terminate(p.StopTimeout, s.events, s.logger)
+}
@@ -0,0 +1,261 @@
+package supervisor
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"rclone-manager/internal/circuit_breaker"
+	"rclone-manager/internal/constants"
+	"rclone-manager/internal/instance_tracker"
+	"rclone-manager/internal/spec"
+	"rclone-manager/internal/status"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	unit      Unit
+	checks    Checks
+	nextCheck time.Time
+	failures  int
+	// checking is set while a check of the unit runs
+	checking bool
+	// failure is why the unit is being stopped for failing its checks
+	failure error
+}
+
+// Supervisor starts, checks, restarts and stops the units of one kind. A unit
+// moves through the states pending, starting, ready, degraded, stopping and
+// stopped, or failed while the circuit breaker of its backend is open.
+type Supervisor struct {
+	kind     string
+	units    map[string]*entry
+	events   *instance_tracker.ExitEvents
+	breakers *circuit_breaker.Breakers
+	status   *status.Recorder
+	logger   zerolog.Logger
+}
+
+func New(kind string, events *instance_tracker.ExitEvents, breakers *circuit_breaker.Breakers, recorder *status.Recorder, logger zerolog.Logger) *Supervisor {
+	return &Supervisor{
+		kind:     kind,
+		units:    make(map[string]*entry),
+		events:   events,
+		breakers: breakers,
+		status:   recorder,
+		logger:   logger.With().Str(constants.LogKind, kind).Logger(),
+	}
+}
+
+// Apply brings the units in line with desired. Units no longer desired and
+// changed ones are stopped first, all in parallel as a busy mount may wait for
+// its holders to let go, so a replacement can take over their mount point or
+// addr. Then new units are started and changed ones restarted, unless ctx is
+// done by then.
+func (s *Supervisor) Apply(ctx context.Context, desired []Unit) {
+	names := make(map[string]bool, len(desired))
+	for _, unit := range desired {
+		names[unit.Process().Name] = true
+	}
+
+	var stops []Unit
+	for name, e := range s.units {
+		if !names[name] {
+			s.logger.Warn().Str(constants.LogName, name).
+				Str(constants.LogBackend, e.unit.Process().BackendName).
+				Msg("Unit removed from config, stopping...")
+			stops = append(stops, e.unit)
+		}
+	}
+
+	var starts, restarts []Unit
+	for _, unit := range desired {
+		p := unit.Process()
+		e, ok := s.units[p.Name]
+		if !ok {
+			starts = append(starts, unit)
+			continue
+		}
+
+		// The newer settings also apply to stopping the unit when it changed
+		e.unit.Refresh(unit)
+		e.checks = e.unit.Checks()
+
+		current := e.unit.Process()
+		if current.Spec.Fingerprint() != p.Spec.Fingerprint() {
+			s.logger.Warn().Str(constants.LogName, p.Name).
+				Str(constants.LogBackend, p.BackendName).
+				Strs(constants.LogChanges, spec.Diff(current.Spec, p.Spec)).
+				Msg("Unit config changed, restarting...")
+			stops = append(stops, e.unit)
+			restarts = append(restarts, unit)
+		}
+	}
+
+	stopped := s.Stop(ctx, stops)
+	if ctx.Err() != nil {
+		// Shutting down, what was not stopped is left to StopAll
+		return
+	}
+	for _, unit := range restarts {
+		if stopped[unit.Process().Name] {
+			_ = s.Start(unit)
+		}
+	}
+	for _, unit := range starts {
+		p := unit.Process()
+		s.logger.Info().Str(constants.LogName, p.Name).
+			Str(constants.LogBackend, p.BackendName).
+			Msg("New unit detected, starting...")
+		_ = s.Start(unit)
+	}
+}
+
+// Start makes a single attempt to start the unit. The unit is tracked even
+// when that fails, so it is retried according to its restart policy.
+func (s *Supervisor) Start(unit Unit) error {
+	p := unit.Process()
+	now := time.Now()
+	checks := unit.Checks()
+	s.units[p.Name] = &entry{
+		unit:      unit,
+		checks:    checks,
+		nextCheck: now.Add(max(checks.InitialDelay, constants.StartupCheckInterval)),
+	}
+
+	cmd := unit.Command()
+	p.Command = cmd
+	p.Exited = false
+	p.ExitErr = nil
+	s.setState(unit, constants.StateStarting)
+
+	err := unit.PreStart()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		p.StartFailed(cmd, err, s.events)
+		s.logger.Warn().AnErr(constants.LogError, err).
+			Str(constants.LogName, p.Name).
+			EmbedObject(unit).
+			Msg("Unit failed to start.")
+		return err
+	}
+
+	s.logger.Info().Str(constants.LogName, p.Name).
+		EmbedObject(unit).
+		Msg("Unit started successfully.")
+	p.PID = cmd.Process.Pid
+	p.StartedAt = now
+	logger := s.logger
+	p.Watch(cmd, s.events, func(event instance_tracker.ExitEvent) {
+		if event.Err != nil {
+			logger.Warn().AnErr(constants.LogError, event.Err).
+				Str(constants.LogName, event.Name).
+				Int(constants.LogExitCode, event.ExitCode).
+				Str(constants.LogSignal, event.Signal).
+				Msg("Unit process exited with error.")
+		} else {
+			logger.Info().
+				Str(constants.LogName, event.Name).
+				Msg("Unit process exited normally.")
+		}
+	})
+	return nil
+}
+
+// Stop stops the units in parallel, each unless its pre-stop hook refuses, in
+// which case it keeps running as it is. A unit whose stop was cut short by ctx
+// keeps being tracked, so StopAll stops it again. It returns the names of the
+// units it stopped.
+func (s *Supervisor) Stop(ctx context.Context, units []Unit) map[string]bool {
+	kept := make([]bool, len(units))
+	var wg sync.WaitGroup
+	for i, unit := range units {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := unit.Process()
+			if err := unit.PreStop(ctx); err != nil {
+				s.logger.Error().AnErr(constants.LogError, err).
+					Str(constants.LogName, p.Name).
+					EmbedObject(unit).
+					Msg("Unit refused to stop, keeping it running until the next reload")
+				kept[i] = true
+				return
+			}
+			kept[i] = s.shutdown(ctx, unit, stopTimeout(ctx, unit)) != nil
+		}()
+	}
+	wg.Wait()
+
+	stopped := make(map[string]bool, len(units))
+	for i, unit := range units {
+		if !kept[i] {
+			name := unit.Process().Name
+			delete(s.units, name)
+			s.status.RemoveUnit(name)
+			stopped[name] = true
+		}
+	}
+	return stopped
+}
+
+// StopAll stops every unit in parallel, each within its stop timeout but no
+// later than the deadline of ctx.
+func (s *Supervisor) StopAll(ctx context.Context) {
+	units := make([]Unit, 0, len(s.units))
+	for _, e := range s.units {
+		units = append(units, e.unit)
+	}
+	clear(s.units)
+
+	var wg sync.WaitGroup
+	for _, unit := range units {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := unit.PreStop(ctx); err != nil {
+				s.logger.Warn().AnErr(constants.LogError, err).
+					Str(constants.LogName, unit.Process().Name).
+					Msg("Stopping unit anyway, as everything is shutting down")
+			}
+			// The process is killed once its timeout ran out rather than given up on
+			_ = s.shutdown(context.WithoutCancel(ctx), unit, stopTimeout(ctx, unit))
+			s.status.RemoveUnit(unit.Process().Name)
+		}()
+	}
+	wg.Wait()
+}
+
+// shutdown stops a unit so the exit it causes is not taken for a crash. It
+// returns the error of ctx when it gave up waiting for the process.
+func (s *Supervisor) shutdown(ctx context.Context, unit Unit, timeout time.Duration) error {
+	p := unit.Process()
+	s.logger.Info().Str(constants.LogName, p.Name).Msg("Stopping unit...")
+	s.setState(unit, constants.StateStopping)
+	if err := p.Shutdown(ctx, timeout, s.logger); err != nil {
+		return err
+	}
+	unit.PostStop()
+	p.State = constants.StateStopped
+	return nil
+}
+
+// stopTimeout shortens the stop timeout of unit so the stop ends with ctx.
+func stopTimeout(ctx context.Context, unit Unit) time.Duration {
+	timeout := unit.Process().StopTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		return instance_tracker.TimeoutWithin(timeout, deadline)
+	}
+	return timeout
+}
+
+func (s *Supervisor) setState(unit Unit, state string) {
+	unit.Process().State = state
+	s.publish(unit)
+}
+
+func (s *Supervisor) publish(unit Unit) {
+	p := unit.Process()
+	s.status.SetUnit(p.Name, s.kind, p.State)
+}
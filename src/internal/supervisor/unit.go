@@ -0,0 +1,74 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"github.com/rs/zerolog"
+	"os"
+	"os/exec"
+	"rclone-manager/internal/environment"
+	"rclone-manager/internal/instance_tracker"
+	"rclone-manager/internal/spec"
+	"time"
+)
+
+// ErrLost is returned by a readiness check when a unit no longer provides
+// what it did, e.g. its mount disappeared. A unit that was ready is then
+// restarted like after a crash, rather than just marked degraded.
+var ErrLost = errors.New("unit lost")
+
+// Unit is a single rclone process the Supervisor runs, e.g. a mount or a
+// serve. The supervisor owns its lifecycle, a unit only knows how to run and
+// check itself. Its log fields are added to every message about it.
+type Unit interface {
+	zerolog.LogObjectMarshaler
+
+	// Process holds the spec, restart settings and state of the unit.
+	Process() *instance_tracker.RcloneProcess
+	// Command builds the command that runs the unit.
+	Command() *exec.Cmd
+	// PreStart runs before every start, an error counts as a failed start.
+	PreStart() error
+	// PreStop runs before the unit is stopped on purpose, and gives up once ctx
+	// is done. An error refuses the stop where it can be refused, i.e. when the
+	// unit is restarted or removed because the config changed.
+	PreStop(ctx context.Context) error
+	// PostStop runs once the process is gone, stopped or exited on its own.
+	PostStop()
+	// Refresh takes over the settings of desired, the same unit built from a
+	// newer config, that apply without a restart.
+	Refresh(desired Unit)
+	// Checks tells how and when the unit is checked.
+	Checks() Checks
+}
+
+// Checks controls the readiness checks of a unit. The first check runs
+// InitialDelay, but at least StartupCheckInterval, after a start, then every
+// StartupCheckInterval until the unit is ready and every Period after that.
+// Failures while starting do not count, a unit that is not ready within
+// StartupTimeout is restarted instead. Once it was ready, FailureThreshold
+// checks in a row failing restart it. 0 disables either.
+//
+// Ready returns an error as long as the unit is not doing its job, wrapping
+// ErrLost when it has to be restarted once it was ready. It runs without the
+// lock the supervisor is called with, so it only uses what it captured when
+// Checks was called rather than the unit, which may be refreshed meanwhile.
+type Checks struct {
+	Ready            func(ctx context.Context) error
+	InitialDelay     time.Duration
+	Period           time.Duration
+	Timeout          time.Duration
+	FailureThreshold int
+	StartupTimeout   time.Duration
+}
+
+// NewCommand builds the command that runs s.
+func NewCommand(s *spec.Spec) *exec.Cmd {
+	cmd := exec.Command(s.Binary, s.Args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	cmd.Env = environment.PrepareEnvironment(s.Environment)
+
+	return cmd
+}
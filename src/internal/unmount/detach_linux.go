@@ -0,0 +1,26 @@
+//go:build linux
+
+package unmount
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+)
+
+// detach unmounts with MNT_DETACH, which needs CAP_SYS_ADMIN.
+func detach(mountPoint string) error {
+	err := unix.Unmount(mountPoint, unix.MNT_DETACH)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, unix.EINVAL), errors.Is(err, unix.ENOENT):
+		return fmt.Errorf("%s: %w: %v", mountPoint, ErrNotMounted, err)
+	case errors.Is(err, unix.EBUSY):
+		return fmt.Errorf("%s: %w: %v", mountPoint, ErrBusy, err)
+	case errors.Is(err, unix.EPERM), errors.Is(err, unix.EACCES):
+		return fmt.Errorf("%s: %w: %v", mountPoint, ErrPermission, err)
+	default:
+		return fmt.Errorf("unmount %s: %w", mountPoint, err)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package unmount
+
+func detach(mountPoint string) error {
+	return errUnsupported
+}
@@ -0,0 +1,85 @@
+package unmount
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const procPath = "/proc"
+
+// Holder is a process with files open, or its working directory, under a
+// mount point, which keeps a lazily unmounted filesystem alive.
+type Holder struct {
+	PID     int
+	Command string
+	Paths   []string
+}
+
+// Holders scans the fds and working directory of every process it may read
+// for paths under mountPoint, and counts the processes it was not permitted to
+// read, which may be using the mount point unnoticed. Reading the links does
+// not touch the mounted filesystem, so it is safe on a hung mount.
+func Holders(mountPoint string) ([]Holder, int, error) {
+	mountPoint = filepath.Clean(mountPoint)
+	entries, err := os.ReadDir(procPath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	self := os.Getpid()
+	var holders []Holder
+	unreadable := 0
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		dir := filepath.Join(procPath, entry.Name())
+
+		seen := make(map[string]bool)
+		var paths []string
+		denied := false
+		add := func(link string) {
+			target, err := os.Readlink(link)
+			if os.IsPermission(err) {
+				denied = true
+			}
+			if err != nil || seen[target] || !under(target, mountPoint) {
+				return
+			}
+			seen[target] = true
+			paths = append(paths, target)
+		}
+
+		add(filepath.Join(dir, "cwd"))
+		fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+		if os.IsPermission(err) {
+			denied = true
+		}
+		for _, fd := range fds {
+			add(filepath.Join(dir, "fd", fd.Name()))
+		}
+		if len(paths) == 0 {
+			if denied {
+				unreadable++
+			}
+			continue
+		}
+
+		command, _ := os.ReadFile(filepath.Join(dir, "comm"))
+		holders = append(holders, Holder{PID: pid, Command: strings.TrimSpace(string(command)), Paths: paths})
+	}
+
+	sort.Slice(holders, func(i, j int) bool {
+		return holders[i].PID < holders[j].PID
+	})
+	return holders, unreadable, nil
+}
+
+func under(path, mountPoint string) bool {
+	path = strings.TrimSuffix(path, " (deleted)")
+	return path == mountPoint || strings.HasPrefix(path, strings.TrimSuffix(mountPoint, "/")+"/")
+}
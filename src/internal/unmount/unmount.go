@@ -0,0 +1,108 @@
+package unmount
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"rclone-manager/internal/mountinfo"
+	"strings"
+)
+
+var (
+	ErrNotMounted = errors.New("not mounted")
+	ErrBusy       = errors.New("mount is busy")
+	ErrPermission = errors.New("not permitted to unmount")
+	// ErrNoFusermount wraps exec.ErrNotFound, the fallback is not installed
+	ErrNoFusermount = fmt.Errorf("no fusermount binary: %w", exec.ErrNotFound)
+
+	errUnsupported = errors.New("native unmount is not supported")
+)
+
+// fusermounts are tried in order, fusermount3 ships with fuse3 and
+// fusermount with fuse2 or as a symlink to fusermount3.
+var fusermounts = []string{"fusermount3", "fusermount"}
+
+// Unmount lazily detaches whatever is mounted at mountPoint. It unmounts
+// natively when the process is allowed to and falls back to fusermount
+// otherwise, then confirms against mountinfo that the mount is gone. Errors
+// wrap ErrNotMounted, ErrBusy or ErrPermission when they are about that, and
+// join ErrNoFusermount to the native error when there is no fallback.
+func Unmount(mountPoint string) error {
+	mountPoint = filepath.Clean(mountPoint)
+
+	mounted, known := topMount(mountPoint)
+	if known && mounted == nil {
+		return fmt.Errorf("%s: %w", mountPoint, ErrNotMounted)
+	}
+
+	err := detach(mountPoint)
+	if errors.Is(err, ErrPermission) || errors.Is(err, errUnsupported) {
+		if fallbackErr := fusermount(mountPoint); errors.Is(fallbackErr, ErrNoFusermount) {
+			err = errors.Join(err, fallbackErr)
+		} else {
+			err = fallbackErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if known {
+		if current, ok := topMount(mountPoint); ok && current != nil && current.ID == mounted.ID {
+			return fmt.Errorf("%s is still mounted after unmounting it", mountPoint)
+		}
+	}
+	return nil
+}
+
+// topMount returns the mount visible at mountPoint, nil when there is none.
+// It reports false when mountinfo cannot be read.
+func topMount(mountPoint string) (*mountinfo.Mount, bool) {
+	mounts, err := mountinfo.Load(mountinfo.Path())
+	if err != nil {
+		return nil, false
+	}
+	mount, ok := mountinfo.At(mounts, mountPoint)
+	if !ok {
+		return nil, true
+	}
+	return &mount, true
+}
+
+func fusermount(mountPoint string) error {
+	binary, err := lookFusermount()
+	if err != nil {
+		return err
+	}
+
+	output, err := exec.Command(binary, "-u", "-z", mountPoint).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	message := strings.TrimSpace(string(output))
+	if message == "" {
+		message = err.Error()
+	}
+
+	lower := strings.ToLower(message)
+	switch {
+	case strings.Contains(lower, "not mounted"), strings.Contains(lower, "not found in"), strings.Contains(lower, "invalid argument"):
+		return fmt.Errorf("%s: %w: %s", mountPoint, ErrNotMounted, message)
+	case strings.Contains(lower, "busy"):
+		return fmt.Errorf("%s: %w: %s", mountPoint, ErrBusy, message)
+	case strings.Contains(lower, "permission denied"), strings.Contains(lower, "not permitted"):
+		return fmt.Errorf("%s: %w: %s", mountPoint, ErrPermission, message)
+	default:
+		return fmt.Errorf("%s %s failed: %s", filepath.Base(binary), mountPoint, message)
+	}
+}
+
+func lookFusermount() (string, error) {
+	for _, name := range fusermounts {
+		if path, err := exec.LookPath(name); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%w: none of %s found on PATH", ErrNoFusermount, strings.Join(fusermounts, ", "))
+}
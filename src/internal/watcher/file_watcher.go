@@ -3,36 +3,68 @@ package watcher
 import (
 	"github.com/fsnotify/fsnotify"
 	"github.com/rs/zerolog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
+// Watcher watches the parent directories of files rather than the files
+// themselves, so atomic saves (write to temp file and rename), sed -i and
+// Kubernetes ConfigMap symlink swaps keep being detected. Bursts of events for
+// a file are coalesced into a single callback once the quiet period has passed.
 type Watcher struct {
-	watcher  *fsnotify.Watcher
-	callback func(string)
-	logger   zerolog.Logger
+	watcher     *fsnotify.Watcher
+	callback    func(string)
+	logger      zerolog.Logger
+	quietPeriod time.Duration
+
+	mu           sync.Mutex
+	files        map[string]string
+	timers       map[string]*time.Timer
+	closed       bool
+	callbackLock sync.Mutex
+	wg           sync.WaitGroup
 }
 
-func NewWatcher(callback func(string), logger zerolog.Logger) *Watcher {
-	w, _ := fsnotify.NewWatcher()
-	return &Watcher{watcher: w, callback: callback, logger: logger}
+func NewWatcher(callback func(string), quietPeriod time.Duration, logger zerolog.Logger) (*Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{
+		watcher:     w,
+		callback:    callback,
+		logger:      logger,
+		quietPeriod: quietPeriod,
+		files:       make(map[string]string),
+		timers:      make(map[string]*time.Timer),
+	}, nil
 }
 
 func (w *Watcher) Watch(files []string) {
+	w.mu.Lock()
 	for _, file := range files {
-		_ = w.watcher.Add(file)
-		w.logger.Debug().Str("file", file).Msg("Watching for changes...")
+		path := filepath.Clean(file)
+		w.files[path] = resolve(path)
+		w.armLocked(path)
+		w.logger.Debug().Str("file", path).Msg("Watching for changes...")
 	}
+	w.mu.Unlock()
 
+	w.wg.Add(1)
 	go func() {
+		defer w.wg.Done()
 		for {
 			select {
 			case event, ok := <-w.watcher.Events:
 				if !ok {
 					return
 				}
-				if event.Op == fsnotify.Write || event.Op == fsnotify.Create {
-					w.logger.Info().Str("file", event.Name).Msg("File modified, triggering reload")
-					w.callback(event.Name)
+				if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+					continue
 				}
+				w.handleEvent(event)
 			case err, ok := <-w.watcher.Errors:
 				if !ok {
 					return
@@ -43,14 +75,109 @@ func (w *Watcher) Watch(files []string) {
 	}()
 }
 
-func StartNewFileWatcher(filesToWatch []string, f func(file string, logger zerolog.Logger), logger zerolog.Logger) {
+func (w *Watcher) handleEvent(event fsnotify.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	eventPath := filepath.Clean(event.Name)
+	for path, target := range w.files {
+		newTarget := resolve(path)
+		if eventPath != path && eventPath != target && newTarget == target {
+			continue
+		}
+
+		if newTarget != target {
+			w.logger.Debug().Str("file", path).Str("target", newTarget).Msg("Symlink target changed, re-arming watch")
+			w.files[path] = newTarget
+		}
+		// Removes and renames drop the watch on the old target's directory, so
+		// always re-arm
+		w.armLocked(path)
+
+		w.logger.Debug().Str("file", path).Str("op", event.Op.String()).Msg("Change detected")
+		w.scheduleLocked(path)
+	}
+}
+
+func (w *Watcher) armLocked(path string) {
+	dirs := []string{filepath.Dir(path)}
+	if target := w.files[path]; target != path {
+		dirs = append(dirs, filepath.Dir(target))
+	}
+	for _, dir := range dirs {
+		if err := w.watcher.Add(dir); err != nil {
+			w.logger.Warn().Err(err).Str("dir", dir).Msg("Failed to watch directory")
+		}
+	}
+}
+
+func (w *Watcher) scheduleLocked(path string) {
+	if timer, ok := w.timers[path]; ok {
+		timer.Reset(w.quietPeriod)
+		return
+	}
+	w.timers[path] = time.AfterFunc(w.quietPeriod, func() {
+		w.mu.Lock()
+		delete(w.timers, path)
+		w.mu.Unlock()
+		w.fire(path)
+	})
+}
+
+func (w *Watcher) fire(path string) {
+	if _, err := os.Stat(path); err != nil {
+		w.logger.Warn().Err(err).Str("file", path).Msg("File is missing after change, waiting for it to reappear")
+		return
+	}
+
+	w.callbackLock.Lock()
+	defer w.callbackLock.Unlock()
+
+	w.mu.Lock()
+	closed := w.closed
+	w.mu.Unlock()
+	if closed {
+		return
+	}
+
+	w.logger.Info().Str("file", path).Msg("File modified, triggering reload")
+	w.callback(path)
+}
+
+func StartNewFileWatcher(filesToWatch []string, quietPeriod time.Duration, f func(file string, logger zerolog.Logger), logger zerolog.Logger) (*Watcher, error) {
 	wrappedCallback := func(file string) {
 		f(file, logger)
 	}
-	w := NewWatcher(wrappedCallback, logger)
+	w, err := NewWatcher(wrappedCallback, quietPeriod, logger)
+	if err != nil {
+		return nil, err
+	}
 	w.Watch(filesToWatch)
+	return w, nil
 }
 
+// Close stops watching and returns once no callback is running anymore.
 func (w *Watcher) Close() {
+	w.mu.Lock()
+	w.closed = true
+	for path, timer := range w.timers {
+		timer.Stop()
+		delete(w.timers, path)
+	}
+	w.mu.Unlock()
 	_ = w.watcher.Close()
+	w.wg.Wait()
+
+	w.callbackLock.Lock()
+	defer w.callbackLock.Unlock()
+}
+
+// resolve follows symlinks, falling back to the path itself while it does
+// not exist (e.g. between the remove and create of an atomic save).
+func resolve(path string) string {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return path
+	}
+	return filepath.Clean(target)
 }
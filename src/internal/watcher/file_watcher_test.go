@@ -0,0 +1,158 @@
+package watcher
+
+import (
+	"github.com/rs/zerolog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const quietPeriod = 100 * time.Millisecond
+
+// watch watches path and returns the channel its callbacks arrive on.
+func watch(t *testing.T, path string) <-chan string {
+	calls := make(chan string, 16)
+	w, err := NewWatcher(func(file string) { calls <- file }, quietPeriod, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.Close)
+	w.Watch([]string{path})
+	return calls
+}
+
+// expectCalls waits for n callbacks for path, and for no more to follow.
+func expectCalls(t *testing.T, calls <-chan string, path string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case file := <-calls:
+			if file != path {
+				t.Fatalf("callback for %s, want %s", file, path)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %d callbacks, want %d", i, n)
+		}
+	}
+	select {
+	case file := <-calls:
+		t.Fatalf("unexpected callback for %s after %d", file, n)
+	case <-time.After(5 * quietPeriod):
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteBurstIsCoalesced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, path, "a")
+	calls := watch(t, path)
+
+	for i := 0; i < 10; i++ {
+		writeFile(t, path, string(rune('a'+i)))
+		time.Sleep(quietPeriod / 50)
+	}
+	expectCalls(t, calls, path, 1)
+}
+
+func TestAtomicSaveByRename(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	writeFile(t, path, "a")
+	calls := watch(t, path)
+
+	for _, content := range []string{"b", "c"} {
+		tmp := filepath.Join(dir, ".config.yaml.tmp")
+		writeFile(t, tmp, content)
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+		expectCalls(t, calls, path, 1)
+	}
+}
+
+func TestSedInPlace(t *testing.T) {
+	sed, err := exec.LookPath("sed")
+	if err != nil {
+		t.Skip("sed is not available")
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, path, "value: a\n")
+	calls := watch(t, path)
+
+	for _, expr := range []string{"s/a/b/", "s/b/c/"} {
+		if out, err := exec.Command(sed, "-i", expr, path).CombinedOutput(); err != nil {
+			t.Fatalf("sed -i: %v: %s", err, out)
+		}
+		expectCalls(t, calls, path, 1)
+	}
+}
+
+// TestConfigMapSymlinkSwap swaps the ..data symlink the way the kubelet
+// updates a mounted ConfigMap, where the file is a symlink into ..data.
+func TestConfigMapSymlinkSwap(t *testing.T) {
+	dir := t.TempDir()
+	revision := func(name, content string) {
+		t.Helper()
+		if err := os.Mkdir(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filepath.Join(dir, name, "config.yaml"), content)
+	}
+	swap := func(name string) {
+		t.Helper()
+		tmp := filepath.Join(dir, "..data_tmp")
+		if err := os.Symlink(name, tmp); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	revision("..rev1", "a")
+	if err := os.Symlink("..rev1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.Symlink(filepath.Join("..data", "config.yaml"), path); err != nil {
+		t.Fatal(err)
+	}
+	calls := watch(t, path)
+
+	previous := "..rev1"
+	for _, name := range []string{"..rev2", "..rev3"} {
+		revision(name, name)
+		swap(name)
+		if err := os.RemoveAll(filepath.Join(dir, previous)); err != nil {
+			t.Fatal(err)
+		}
+		previous = name
+		expectCalls(t, calls, path, 1)
+	}
+}
+
+func TestRemoveAndCreateRearms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, path, "a")
+	calls := watch(t, path)
+
+	// Nothing to reload while the file is missing
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(t, calls, path, 0)
+
+	writeFile(t, path, "b")
+	expectCalls(t, calls, path, 1)
+
+	writeFile(t, path, "c")
+	expectCalls(t, calls, path, 1)
+}